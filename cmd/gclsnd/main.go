@@ -1,23 +1,33 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/atomic-7/gocalsend/internal/config"
 	"github.com/atomic-7/gocalsend/internal/data"
 	"github.com/atomic-7/gocalsend/internal/discovery"
 	"github.com/atomic-7/gocalsend/internal/encryption"
+	"github.com/atomic-7/gocalsend/internal/ratelimit"
 	"github.com/atomic-7/gocalsend/internal/server"
 	"github.com/atomic-7/gocalsend/internal/sessions"
 	"github.com/atomic-7/gocalsend/internal/uploader"
 	"github.com/charmbracelet/log"
 )
 
+// how long running transfers get to finish when the program exits
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 
 	// setup logger so config loading can log, reconfigure later
@@ -30,6 +40,7 @@ func main() {
 	appConf, err := config.Setup()
 	if err != nil {
 		slog.Error("failed to setup configuration. exiting.", slog.Any("err", err))
+		os.Exit(1)
 	}
 
 	command := appConf.CliArgs["cmd"]
@@ -65,7 +76,15 @@ func main() {
 		Announce:    false,
 	}
 
+	// the download api is only active while files are shared
+	if command == "share" {
+		node.Download = true
+	}
+
+	// plain http unless tls is enabled
+	var tlsInfo *data.TLSPaths
 	if appConf.UseTLS {
+		tlsInfo = appConf.TLSInfo
 		slog.Debug("setting up tls",
 			slog.String("dir", appConf.TLSInfo.Dir),
 			slog.String("cert", appConf.TLSInfo.Cert),
@@ -96,9 +115,16 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// the limits are configured in KiB per second and shared by all sessions
+	sendLimit := ratelimit.NewBandwidth(appConf.SendLimit*1024, appConf.PeerSendLimit*1024)
+	receiveLimit := ratelimit.NewBandwidth(appConf.ReceiveLimit*1024, appConf.PeerReceiveLimit*1024)
 
 	hui := sessions.HeadlessUI{}
-	sessionManager := sessions.NewSessionManager(ctx, appConf.DownloadFolder, &hui)
+	sessionManager, err := newSessionManager(ctx, appConf, &hui)
+	if err != nil {
+		slog.Error("invalid configuration", slog.Any("error", err))
+		os.Exit(1)
+	}
 	registratinator := discovery.NewRegistratinator(node)
 	multicastAddr := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 167), Port: 53317}
 	runAnnouncement := func() {
@@ -108,7 +134,18 @@ func main() {
 		}
 	}
 
-	go server.StartServer(ctx, node, peers, sessionManager, appConf.TLSInfo, appConf.DownloadFolder)
+	srv, err := server.New(node, peers, sessionManager, tlsInfo, appConf.Pin, server.Limits{RequestRate: appConf.RequestRate, UploadRate: appConf.UploadRate, Receive: receiveLimit, Send: sendLimit})
+	if err != nil {
+		slog.Error("failed to setup server", slog.Any("error", err))
+		os.Exit(1)
+	}
+	defer shutdown(srv)
+	go func() {
+		if err := srv.Start(); err != nil {
+			slog.Error("server error", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}()
 	go discovery.MonitorMulticast(ctx, multicastAddr, node, peers, registratinator)
 	runAnnouncement()
 	switch command {
@@ -147,17 +184,69 @@ func main() {
 		}
 		peers.ReleaseMap()
 		slog.Debug("Peer", slog.Any("info", target))
-		upl := uploader.CreateUploader(node, sessionManager)
-		upl.UploadFiles(target, flag.Args())
+		upl := newUploader(node, sessionManager, appConf, sendLimit)
+		// ctrl+c cancels the upload, the peer is told about it
+		sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		send := func(pin string) error {
+			if text := appConf.CliArgs["text"]; text != "" {
+				return upl.SendText(sigCtx, target, text, pin)
+			}
+			return upl.UploadFiles(sigCtx, target, flag.Args(), pin)
+		}
+		err := send("")
+		for errors.Is(err, uploader.ErrInvalidPin) {
+			err = send(promptPin())
+		}
+		if err != nil {
+			slog.Error("upload failed", slog.Any("error", err))
+			os.Exit(1)
+		}
+	case "share":
+		if len(flag.Args()) == 0 {
+			slog.Error("no files to share specified")
+			os.Exit(1)
+		}
+		upl := newUploader(node, sessionManager, appConf, sendLimit)
+		files, err := upl.CollectFiles(flag.Args())
+		if err != nil {
+			slog.Error("failed to collect files to share", slog.Any("error", err))
+			os.Exit(1)
+		}
+		sessionManager.ShareFiles(files)
+		slog.Info("sharing files", slog.Int("files", len(files)), slog.Int("port", node.Port))
+		ticker := time.NewTicker(1 * time.Minute)
+		defer ticker.Stop()
+		// ctrl+c stops the node, running transfers still get to finish
+		sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		intervalRunner(sigCtx, runAnnouncement, ticker)
+		// a second ctrl+c exits right away
+		stop()
 	case "rcv", "rec", "recv", "receive":
 		ticker := time.NewTicker(1 * time.Minute)
 		defer ticker.Stop()
-		intervalRunner(ctx, runAnnouncement, ticker)
+		// ctrl+c stops the node, running transfers still get to finish
+		sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		intervalRunner(sigCtx, runAnnouncement, ticker)
+		// a second ctrl+c exits right away
+		stop()
 	default:
 		slog.Error("unknown command", slog.String("cmd", command))
 	}
 }
 
+// ask the user for the pin of the peer on the command line
+func promptPin() string {
+	fmt.Print("Peer requires a pin: ")
+	reader := bufio.NewReader(os.Stdin)
+	pin, err := reader.ReadString('\n')
+	if err != nil {
+		slog.Error("failed to read pin", slog.Any("error", err))
+		os.Exit(1)
+	}
+	return strings.TrimSpace(pin)
+}
+
 func intervalRunner(ctx context.Context, f func(), ticker *time.Ticker) {
 	for {
 		select {
@@ -169,3 +258,43 @@ func intervalRunner(ctx context.Context, f func(), ticker *time.Ticker) {
 		}
 	}
 }
+
+// session manager configured with the receive settings, used by every command
+func newSessionManager(ctx context.Context, appConf *config.Config, ui sessions.UIHooks) (*sessions.SessionManager, error) {
+	conflicts, err := sessions.ParseConflictPolicy(appConf.ConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := sessions.ParseReceivePolicy(appConf.ReceivePolicy)
+	if err != nil {
+		return nil, err
+	}
+	sman := sessions.NewSessionManager(ctx, appConf.DownloadFolder, ui)
+	sman.Conflicts = conflicts
+	sman.MaxFileSize = appConf.MaxFileSize
+	sman.MaxSessionSize = appConf.MaxSessionSize
+	sman.KeepFileTimes = appConf.KeepFileTimes
+	sman.Policy = policy
+	sman.MaxSessions = appConf.MaxSessions
+	sman.MaxOffers = appConf.MaxPendingOffers
+	return sman, nil
+}
+
+// uploader configured with the send settings, used by send and share
+func newUploader(node *data.PeerInfo, sman *sessions.SessionManager, appConf *config.Config, sendLimit *ratelimit.Bandwidth) *uploader.Uploader {
+	upl := uploader.CreateUploader(node, sman)
+	upl.HashFiles = appConf.HashFiles
+	upl.Workers = appConf.UploadWorkers
+	upl.BlockedRetries = appConf.BlockedRetries
+	upl.Bandwidth = sendLimit
+	return upl
+}
+
+// give running transfers some time to finish before exiting
+func shutdown(srv *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("server shutdown failed", slog.Any("error", err))
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
@@ -15,6 +21,7 @@ import (
 	"github.com/atomic-7/gocalsend/internal/data"
 	"github.com/atomic-7/gocalsend/internal/discovery"
 	"github.com/atomic-7/gocalsend/internal/encryption"
+	"github.com/atomic-7/gocalsend/internal/ratelimit"
 	"github.com/atomic-7/gocalsend/internal/server"
 	"github.com/atomic-7/gocalsend/internal/sessions"
 	"github.com/atomic-7/gocalsend/internal/tui"
@@ -22,6 +29,9 @@ import (
 	"github.com/atomic-7/gocalsend/internal/uploader"
 )
 
+// how long running transfers get to finish when the program exits
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 
 	logOpts := log.Options{
@@ -33,6 +43,7 @@ func main() {
 	appConf, err := config.Setup()
 	if err != nil {
 		slog.Error("error setting up config", slog.Any("err", err))
+		os.Exit(1)
 	}
 
 	logOpts = log.Options{
@@ -74,7 +85,15 @@ func main() {
 		Announce:    false,
 	}
 
+	// the download api is only active while files are shared
+	if appConf.CliArgs["cmd"] == "share" {
+		node.Download = true
+	}
+
+	// plain http unless tls is enabled
+	var tlsInfo *data.TLSPaths
 	if appConf.UseTLS {
+		tlsInfo = appConf.TLSInfo
 		slog.Debug("setting up tls",
 			slog.String("dir", appConf.TLSInfo.Dir),
 			slog.String("cert", appConf.TLSInfo.Cert),
@@ -103,6 +122,9 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	// the limits are configured in KiB per second and shared by all sessions
+	sendLimit := ratelimit.NewBandwidth(appConf.SendLimit*1024, appConf.PeerSendLimit*1024)
+	receiveLimit := ratelimit.NewBandwidth(appConf.ReceiveLimit*1024, appConf.PeerReceiveLimit*1024)
 
 	slog.Debug("config", slog.Int("mode", int(appConf.Mode)))
 	var peers data.PeerTracker
@@ -114,11 +136,28 @@ func main() {
 		peers = hooks.NewPeerMap(p)
 		runAnnouncement := announcer(ctx, node, multicastAddr, peers, registratinator)
 		eventHooks = hooks.NewHooks(p)
-		sessionManager := sessions.NewSessionManager(ctx, appConf.DownloadFolder, eventHooks)
-		model.Uploader = uploader.CreateUploader(node, sessionManager)
+		sessionManager, err := newSessionManager(ctx, appConf, eventHooks)
+		if err != nil {
+			slog.Error("invalid configuration", slog.Any("error", err))
+			os.Exit(1)
+		}
+		model.Uploader = newUploader(node, sessionManager, appConf, sendLimit)
 		// dlManager := sessions.NewSessionManager(appConf.DownloadFolder, uihooks)
 		model.SetupSessionManagers(sessionManager)
-		go server.StartServer(ctx, node, peers, sessionManager, appConf.TLSInfo, appConf.DownloadFolder)
+		model.SetupBandwidth(sendLimit, receiveLimit)
+		srv, err := server.New(node, peers, sessionManager, tlsInfo, appConf.Pin, server.Limits{RequestRate: appConf.RequestRate, UploadRate: appConf.UploadRate, Receive: receiveLimit, Send: sendLimit})
+		if err != nil {
+			slog.Error("failed to setup server", slog.Any("error", err))
+			os.Exit(1)
+		}
+		defer shutdown(srv)
+		go func() {
+			if err := srv.Start(); err != nil {
+				slog.Error("server error", slog.Any("error", err))
+				// let the tui restore the terminal before exiting
+				p.Quit()
+			}
+		}()
 		go discovery.MonitorMulticast(ctx, multicastAddr, node, peers, registratinator)
 		runAnnouncement()
 		ticker := time.NewTicker(1 * time.Minute)
@@ -139,9 +178,24 @@ func main() {
 		peers = peerMap
 		runAnnouncement := announcer(ctx, node, multicastAddr, peers, registratinator)
 		eventHooks = &sessions.HeadlessUI{}
-		sessionManager := sessions.NewSessionManager(ctx, appConf.DownloadFolder, eventHooks)
+		sessionManager, err := newSessionManager(ctx, appConf, eventHooks)
+		if err != nil {
+			slog.Error("invalid configuration", slog.Any("error", err))
+			os.Exit(1)
+		}
 
-		go server.StartServer(ctx, node, peers, sessionManager, appConf.TLSInfo, appConf.DownloadFolder)
+		srv, err := server.New(node, peers, sessionManager, tlsInfo, appConf.Pin, server.Limits{RequestRate: appConf.RequestRate, UploadRate: appConf.UploadRate, Receive: receiveLimit, Send: sendLimit})
+		if err != nil {
+			slog.Error("failed to setup server", slog.Any("error", err))
+			os.Exit(1)
+		}
+		defer shutdown(srv)
+		go func() {
+			if err := srv.Start(); err != nil {
+				slog.Error("server error", slog.Any("error", err))
+				os.Exit(1)
+			}
+		}()
 		go discovery.MonitorMulticast(ctx, multicastAddr, node, peers, registratinator)
 		runAnnouncement()
 		switch appConf.CliArgs["cmd"] {
@@ -180,15 +234,56 @@ func main() {
 			}
 			peerMap.ReleaseMap()
 			slog.Debug("Peer", slog.Any("info", target))
-			upl := uploader.CreateUploader(node, sessionManager)
+			upl := newUploader(node, sessionManager, appConf, sendLimit)
 			// passing the args will only work while cmd is passed as --cmd
 			// this will need to be changed when the command will be passed directly
-			upl.UploadFiles(target, flag.Args())
+			// ctrl+c cancels the upload, the peer is told about it
+			sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			send := func(pin string) error {
+				if text := appConf.CliArgs["text"]; text != "" {
+					return upl.SendText(sigCtx, target, text, pin)
+				}
+				return upl.UploadFiles(sigCtx, target, flag.Args(), pin)
+			}
+			err := send("")
+			for errors.Is(err, uploader.ErrInvalidPin) {
+				err = send(promptPin())
+			}
+			if err != nil {
+				slog.Error("upload failed", slog.Any("error", err))
+				os.Exit(1)
+			}
+
+		case "share":
+			if len(flag.Args()) == 0 {
+				slog.Error("no files to share specified")
+				os.Exit(1)
+			}
+			upl := newUploader(node, sessionManager, appConf, sendLimit)
+			files, err := upl.CollectFiles(flag.Args())
+			if err != nil {
+				slog.Error("failed to collect files to share", slog.Any("error", err))
+				os.Exit(1)
+			}
+			sessionManager.ShareFiles(files)
+			slog.Info("sharing files", slog.Int("files", len(files)), slog.Int("port", node.Port))
+			ticker := time.NewTicker(1 * time.Minute)
+			defer ticker.Stop()
+			// ctrl+c stops the node, running transfers still get to finish
+			sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			intervalRunner(sigCtx, runAnnouncement, ticker)
+			// a second ctrl+c exits right away
+			stop()
 
 		case "rcv", "rec", "recv", "receive":
 			ticker := time.NewTicker(1 * time.Minute)
 			defer ticker.Stop()
-			intervalRunner(ctx, runAnnouncement, ticker)
+			// ctrl+c stops the node, running transfers still get to finish
+			sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+			intervalRunner(sigCtx, runAnnouncement, ticker)
+			// a second ctrl+c exits right away
+			stop()
 
 		default:
 			slog.Error("unknown command", slog.String("cmd", appConf.CliArgs["cmd"]))
@@ -201,6 +296,18 @@ func main() {
 
 }
 
+// ask the user for the pin of the peer on the command line
+func promptPin() string {
+	fmt.Print("Peer requires a pin: ")
+	reader := bufio.NewReader(os.Stdin)
+	pin, err := reader.ReadString('\n')
+	if err != nil {
+		slog.Error("failed to read pin", slog.Any("error", err))
+		os.Exit(1)
+	}
+	return strings.TrimSpace(pin)
+}
+
 func intervalRunner(ctx context.Context, f func(), ticker *time.Ticker) {
 	for {
 		select {
@@ -221,3 +328,43 @@ func announcer(ctx context.Context, node *data.PeerInfo, multicastAddr *net.UDPA
 		}
 	}
 }
+
+// the tui and the cli set up their session manager here, so a new setting reaches both modes
+func newSessionManager(ctx context.Context, appConf *config.Config, ui sessions.UIHooks) (*sessions.SessionManager, error) {
+	conflicts, err := sessions.ParseConflictPolicy(appConf.ConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := sessions.ParseReceivePolicy(appConf.ReceivePolicy)
+	if err != nil {
+		return nil, err
+	}
+	sman := sessions.NewSessionManager(ctx, appConf.DownloadFolder, ui)
+	sman.Conflicts = conflicts
+	sman.MaxFileSize = appConf.MaxFileSize
+	sman.MaxSessionSize = appConf.MaxSessionSize
+	sman.KeepFileTimes = appConf.KeepFileTimes
+	sman.Policy = policy
+	sman.MaxSessions = appConf.MaxSessions
+	sman.MaxOffers = appConf.MaxPendingOffers
+	return sman, nil
+}
+
+// same for the uploader of the tui and of the send and share commands
+func newUploader(node *data.PeerInfo, sman *sessions.SessionManager, appConf *config.Config, sendLimit *ratelimit.Bandwidth) *uploader.Uploader {
+	upl := uploader.CreateUploader(node, sman)
+	upl.HashFiles = appConf.HashFiles
+	upl.Workers = appConf.UploadWorkers
+	upl.BlockedRetries = appConf.BlockedRetries
+	upl.Bandwidth = sendLimit
+	return upl
+}
+
+// give running transfers some time to finish before exiting
+func shutdown(srv *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("server shutdown failed", slog.Any("error", err))
+	}
+}
@@ -95,12 +95,23 @@ func main() {
 	}
 	hui := sessions.HeadlessUI{}
 	sessionManager := sessions.NewSessionManager(ctx, outFolder, &hui)
-	go server.StartServer(ctx, &node, peers, sessionManager, tlsInfo, outFolder)
+	srv, err := server.New(&node, peers, sessionManager, tlsInfo, "", server.Limits{})
+	if err != nil {
+		slog.Error("failed to setup server", slog.Any("error", err))
+		os.Exit(1)
+	}
+	go func() {
+		if err := srv.Start(); err != nil {
+			slog.Error("server error", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}()
+	defer srv.Shutdown(context.Background())
 	go discovery.MonitorMulticast(ctx, multicastAddr, &node, peers, registratinator)
 
 	upl := uploader.CreateUploader(&node, sessionManager)
 
 	time.Sleep(5000)
-	upl.UploadFiles(&peer, flag.Args())
+	upl.UploadFiles(ctx, &peer, flag.Args(), "")
 
 }
@@ -23,6 +23,23 @@ type Config struct {
 	Port              int
 	PeerDiscoveryTime int `comment:"Time to search for peers when sending"`
 	LogLevel          string
+	Pin               string  `comment:"Pin peers have to supply to send files to this device. Leave empty to accept without a pin"`
+	HashFiles         bool    `comment:"Compute the sha256 of files before sending them so peers can verify them"`
+	UploadWorkers     int     `comment:"Number of files that are uploaded in parallel"`
+	ConflictPolicy    string  `comment:"What to do when a received file already exists: rename, overwrite, skip or ask"`
+	MaxFileSize       int64   `comment:"Refuse sessions containing files larger than this many bytes, 0 for no limit"`
+	MaxSessionSize    int64   `comment:"Refuse sessions larger than this many bytes in total, 0 for no limit"`
+	KeepFileTimes     bool    `comment:"Give received files the modification and access time of the original file"`
+	ReceivePolicy     string  `comment:"How many sessions can be received at the same time: single, concurrent (up to MaxSessions) or peer (one per peer)"`
+	MaxSessions       int     `comment:"Number of sessions that can be received at the same time with the concurrent policy, 0 for no limit"`
+	BlockedRetries    int     `comment:"How often to retry sending when the peer is busy with another session"`
+	RequestRate       float64 `comment:"Api requests per second a peer can make before being answered with 429, 0 for no limit"`
+	UploadRate        float64 `comment:"File upload and download requests per second a peer can make, 0 for no limit"`
+	MaxPendingOffers  int     `comment:"Number of incoming sessions that can wait to be accepted at the same time, 0 for no limit"`
+	SendLimit         float64 `comment:"KiB per second all uploads together can use, 0 for no limit"`
+	ReceiveLimit      float64 `comment:"KiB per second all incoming transfers together can use, 0 for no limit"`
+	PeerSendLimit     float64 `comment:"KiB per second the uploads to a single peer can use, 0 for no limit"`
+	PeerReceiveLimit  float64 `comment:"KiB per second the incoming transfers of a single peer can use, 0 for no limit"`
 	UseTLS            bool
 	TLSInfo           *data.TLSPaths
 	Version           int
@@ -49,6 +66,23 @@ func Default() (*Config, error) {
 		Port:              53317,
 		PeerDiscoveryTime: 4,
 		LogLevel:          "info",
+		Pin:               "",
+		HashFiles:         false,
+		UploadWorkers:     4,
+		ConflictPolicy:    "rename",
+		MaxFileSize:       0,
+		MaxSessionSize:    0,
+		KeepFileTimes:     true,
+		ReceivePolicy:     "single",
+		MaxSessions:       0,
+		BlockedRetries:    0,
+		RequestRate:       5,
+		UploadRate:        200,
+		MaxPendingOffers:  5,
+		SendLimit:         0,
+		ReceiveLimit:      0,
+		PeerSendLimit:     0,
+		PeerReceiveLimit:  0,
 		UseTLS:            true,
 		TLSInfo: &data.TLSPaths{
 			Dir: filepath.Join(confdir, "gocalsend"),
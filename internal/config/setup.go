@@ -47,9 +47,11 @@ func Setup() (*Config, error) {
 	// these are only here for the cli. maybe this can be passed on more elegantly
 	cmd := "recv"
 	peer := ""
+	text := ""
 
-	flag.StringVar(&cmd, "cmd", cmd, "The command to execute. (recv, send, ls)")
-	flag.StringVar(&cmd, "peer", peer, "Peer to send to. Find available with '--cmd=ls'")
+	flag.StringVar(&cmd, "cmd", cmd, "The command to execute. (recv, send, share, ls)")
+	flag.StringVar(&peer, "peer", peer, "Peer to send to. Find available with '--cmd=ls'")
+	flag.StringVar(&text, "text", text, "Text message to send instead of files")
 	flag.IntVar(&appConf.Port, "port", appConf.Port, "The port to listen for the api endpoints")
 	flag.StringVar(&appConf.TLSInfo.Cert, "cert", appConf.TLSInfo.Cert, "The filename of the tls certificate")
 	flag.StringVar(&appConf.TLSInfo.Key, "key", appConf.TLSInfo.Key, "The filename of the tls private key")
@@ -57,6 +59,21 @@ func Setup() (*Config, error) {
 	flag.BoolVar(&appConf.UseTLS, "usetls", appConf.UseTLS, "Use https (usetls=true) or use http (usetls=false)")
 	flag.StringVar(&appConf.LogLevel, "loglevel", appConf.LogLevel, "Log level can be 'info', 'debug' or 'none'")
 	flag.IntVar(&appConf.PeerDiscoveryTime, "lstime", appConf.PeerDiscoveryTime, "time to wait for peer discovery")
+	flag.StringVar(&appConf.Pin, "pin", appConf.Pin, "Pin peers have to supply to send files to this device")
+	flag.BoolVar(&appConf.HashFiles, "hash", appConf.HashFiles, "Compute the sha256 of files before sending them")
+	flag.IntVar(&appConf.UploadWorkers, "workers", appConf.UploadWorkers, "Number of files that are uploaded in parallel")
+	flag.StringVar(&appConf.ConflictPolicy, "conflict", appConf.ConflictPolicy, "What to do when a received file already exists: rename, overwrite, skip or ask")
+	flag.Int64Var(&appConf.MaxFileSize, "maxfile", appConf.MaxFileSize, "Refuse sessions containing files larger than this many bytes, 0 for no limit")
+	flag.Int64Var(&appConf.MaxSessionSize, "maxsession", appConf.MaxSessionSize, "Refuse sessions larger than this many bytes in total, 0 for no limit")
+	flag.BoolVar(&appConf.KeepFileTimes, "keeptimes", appConf.KeepFileTimes, "Give received files the modification and access time of the original file")
+	flag.StringVar(&appConf.ReceivePolicy, "policy", appConf.ReceivePolicy, "How many sessions can be received at the same time: single, concurrent or peer")
+	flag.IntVar(&appConf.MaxSessions, "maxsessions", appConf.MaxSessions, "Number of sessions that can be received at the same time with the concurrent policy")
+	flag.IntVar(&appConf.BlockedRetries, "retries", appConf.BlockedRetries, "How often to retry sending when the peer is busy with another session")
+	flag.Float64Var(&appConf.RequestRate, "reqrate", appConf.RequestRate, "Api requests per second a peer can make, 0 for no limit")
+	flag.Float64Var(&appConf.SendLimit, "sendlimit", appConf.SendLimit, "KiB per second all uploads together can use, 0 for no limit")
+	flag.Float64Var(&appConf.ReceiveLimit, "recvlimit", appConf.ReceiveLimit, "KiB per second all incoming transfers together can use, 0 for no limit")
+	flag.Float64Var(&appConf.PeerSendLimit, "peersendlimit", appConf.PeerSendLimit, "KiB per second the uploads to a single peer can use, 0 for no limit")
+	flag.Float64Var(&appConf.PeerReceiveLimit, "peerrecvlimit", appConf.PeerReceiveLimit, "KiB per second the incoming transfers of a single peer can use, 0 for no limit")
 	flag.StringVar(&appConf.DownloadFolder, "out", appConf.DownloadFolder, "path to where incoming files are saved")
 	flag.StringVar(&configPath, "config", configPath, "Path to the config.toml file")
 	flag.Parse()
@@ -82,7 +99,7 @@ func Setup() (*Config, error) {
 	}
 	slog.Info("download folder", slog.String("out", appConf.DownloadFolder))
 
-	if cmd == "ls" || peer != "" {
+	if cmd == "ls" || cmd == "share" || peer != "" {
 		appConf.Mode = AppMode(CLI)
 	} else {
 		appConf.Mode = AppMode(TUI)
@@ -90,6 +107,7 @@ func Setup() (*Config, error) {
 
 	appConf.CliArgs["cmd"] = cmd
 	appConf.CliArgs["peer"] = peer
+	appConf.CliArgs["text"] = text
 
 	return appConf, nil
 }
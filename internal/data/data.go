@@ -3,6 +3,7 @@ package data
 import (
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 )
 
@@ -17,7 +18,14 @@ type PeerInfo struct {
 	Protocol    string `json:"protocol"` // http | https
 	Download    bool   `json:"download"` // API > 5.2
 	Announce    bool   `json:"announce"` // announce field is on peerinfo because it makes parsing easy, announce can just be checked as a property of the struct this way
-	IP          net.IP `json:"-"`
+	// protocol v1 calls the announce field announcement
+	Announcement bool   `json:"announcement,omitempty"`
+	IP           net.IP `json:"-"`
+}
+
+// Peers running protocol v1 do not send a version, newer ones send major.minor
+func (pi *PeerInfo) IsV1() bool {
+	return pi.Version == "" || strings.HasPrefix(pi.Version, "1.")
 }
 
 func (pi *PeerInfo) ToPeerBody() *PeerBody {
@@ -29,7 +37,7 @@ func (pi *PeerInfo) ToPeerBody() *PeerBody {
 		Fingerprint: pi.Fingerprint,
 		Port:        pi.Port,
 		Protocol:    pi.Protocol,
-		Download:    false,
+		Download:    pi.Download,
 	}
 }
 
@@ -41,7 +49,7 @@ func (pi *PeerInfo) ToRegisterResponse() *RegisterResponse {
 		DeviceType:  pi.DeviceType,
 		Fingerprint: pi.Fingerprint,
 		Port:        pi.Port,
-		Download:    false,
+		Download:    pi.Download,
 	}
 }
 
@@ -54,8 +62,10 @@ func (pi *PeerInfo) ToAnnouncement() *AnnounceInfo {
 		Fingerprint: pi.Fingerprint,
 		Port:        pi.Port,
 		Protocol:    pi.Protocol,
-		Download:    false,
+		Download:    pi.Download,
 		Announce:    true,
+		// v1 peers only answer if announcement is set
+		Announcement: true,
 	}
 }
 
@@ -93,6 +103,8 @@ type AnnounceInfo struct {
 	Protocol    string `json:"protocol"` // http | https
 	Download    bool   `json:"download"` // API > 5.2
 	Announce    bool   `json:"announce"`
+	// v1 name of the announce field
+	Announcement bool `json:"announcement"`
 }
 
 type PeerTracker interface {
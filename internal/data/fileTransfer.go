@@ -4,6 +4,9 @@ import (
 	"time"
 )
 
+// Response header of gocalsend peers that reports how many bytes of an interrupted upload were already received
+const ResumeOffsetHeader = "X-Gocalsend-Offset"
+
 type MetaData struct {
 	Modified time.Time `json:"modified"` // nullable
 	Accessed time.Time `json:"accessed"` // nullable
@@ -19,7 +22,7 @@ type File struct {
 	Metadata    *MetaData `json:"metadata"` // nullable
 	Done        bool      `json:"-"`
 	Token       string    `json:"-"`
-	Destination string    `json:"-"`
+	Destination string    `json:"-"` // source path when sending, resolved target path when receiving
 }
 
 type PreparePayload struct {
@@ -31,3 +34,9 @@ type SessionInfo struct {
 	SessionID string            `json:"sessionId"`
 	Files     map[string]string `json:"files"` // fileid -> token
 }
+
+type PrepareDownloadResponse struct {
+	Info      *RegisterResponse `json:"info"`
+	SessionID string            `json:"sessionId"`
+	Files     map[string]*File  `json:"files"`
+}
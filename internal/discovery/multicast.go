@@ -19,6 +19,7 @@ func RegisterViaMulticast(node *data.PeerInfo, multicastAdress *net.UDPAddr) {
 	}
 	registration := node.ToAnnouncement()
 	registration.Announce = false
+	registration.Announcement = false
 	buf, err := json.Marshal(registration)
 	if err != nil {
 		slog.Error("Error marshalling node", slog.Any("error", err))
@@ -41,7 +42,7 @@ func AnnounceViaMulticast(node *data.PeerInfo, multicastAdress *net.UDPAddr) err
 	}
 	buf, err := json.Marshal(node.ToAnnouncement())
 	if err != nil {
-		slog.Error("Error marshalling node: ", err)
+		slog.Error("Error marshalling node", slog.Any("error", err))
 	}
 	_, err = conn.Write(buf)
 	if err != nil {
@@ -82,6 +83,10 @@ func MonitorMulticast(ctx context.Context, multicastAddr *net.UDPAddr, localnode
 					slog.Error("failed to unmarshal json", slog.Any("error", err))
 					continue
 				}
+				if info.Port == 0 {
+					// v1 announcements do not contain the port, v1 peers listen on the default port
+					info.Port = multicastAddr.Port
+				}
 				slog.Debug("multicast discovery", slog.String("ip", from.String()), slog.String("alias", info.Alias), slog.String("protocol", info.Protocol))
 
 				if localnode.Fingerprint == info.Fingerprint {
@@ -93,13 +98,19 @@ func MonitorMulticast(ctx context.Context, multicastAddr *net.UDPAddr, localnode
 					slog.Debug("received advertisement from known peer", slog.String("peer", info.Alias))
 				}
 
-				if info.Announce {
+				if info.Announce || info.Announcement {
+					if info.IsV1() {
+						// v1 peers do not have a register route and expect the answer via multicast
+						slog.Info("sending local node info via multicast", slog.String("peer", info.Alias))
+						RegisterViaMulticast(localnode, multicastAddr)
+						continue
+					}
 					// TODO: delay this. I am currently sniping a starting instance before the http server is up
 					slog.Info("sending local node info", slog.String("peer", info.Alias))
 					err := registratinator.RegisterAt(ctx, info)
 					if err != nil {
 						slog.Error("failed to send node info to peer", slog.String("peer", info.Alias), slog.Any("error", err))
-						RegisterViaMulticast(info, multicastAddr)
+						RegisterViaMulticast(localnode, multicastAddr)
 					}
 				} else {
 					slog.Info("incoming registry via multicast fallback", slog.String("peer", info.Alias), slog.String("source", "multicast"))
@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// transfers are throttled in chunks of at most this size, so the waits between them stay short
+const chunkSize = 32 << 10
+
+// Caps the bytes per second of file transfers, for all peers together and for every single peer.
+// A nil Bandwidth does not limit anything
+type Bandwidth struct {
+	total     *Bucket
+	peers     *Limiter
+	totalRate float64
+	peerRate  float64
+	lock      sync.Mutex
+}
+
+// a quarter of a second worth of data, enough to keep the transfer smooth without long bursts
+func bandwidthBurst(rate float64) float64 {
+	return max(chunkSize, rate/4)
+}
+
+// Create limits in bytes per second. A limit of 0 or less disables it
+func NewBandwidth(total float64, perPeer float64) *Bandwidth {
+	return &Bandwidth{
+		total:     NewBucket(total, bandwidthBurst(total)),
+		peers:     NewLimiter(perPeer, bandwidthBurst(perPeer)),
+		totalRate: total,
+		peerRate:  perPeer,
+	}
+}
+
+// Change the limits while transfers are running
+func (bw *Bandwidth) SetLimits(total float64, perPeer float64) {
+	if bw == nil {
+		return
+	}
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	bw.total.SetRate(total, bandwidthBurst(total))
+	bw.peers.SetRate(perPeer, bandwidthBurst(perPeer))
+	bw.totalRate = total
+	bw.peerRate = perPeer
+}
+
+// The limits in bytes per second, 0 means no limit
+func (bw *Bandwidth) Limits() (total float64, perPeer float64) {
+	if bw == nil {
+		return 0, 0
+	}
+	bw.lock.Lock()
+	defer bw.lock.Unlock()
+	return max(0, bw.totalRate), max(0, bw.peerRate)
+}
+
+// Wrap the body of a transfer so reading from it keeps to the limits. The key identifies the peer, e.g. by its ip address
+func (bw *Bandwidth) Reader(ctx context.Context, key string, r io.Reader) io.Reader {
+	if bw == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, key: key, r: r, bw: bw}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	key string
+	r   io.Reader
+	bw  *Bandwidth
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p[:min(len(p), chunkSize)])
+	if n == 0 {
+		return n, err
+	}
+	if werr := tr.bw.peers.Wait(tr.ctx, tr.key, float64(n)); werr != nil {
+		return n, werr
+	}
+	if werr := tr.bw.total.Wait(tr.ctx, float64(n)); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
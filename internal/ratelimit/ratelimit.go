@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A token bucket that refills at a constant rate up to its burst size
+type Bucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// Create a full bucket. A rate of 0 or less disables the limit
+func NewBucket(rate float64, burst float64) *Bucket {
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// has to be called with the lock held
+func (b *Bucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Take a token if one is available
+func (b *Bucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// Take n tokens and wait until the bucket refilled enough to cover them. n can be larger than the burst,
+// the bucket then goes into debt that later callers have to wait for. Returns the error of ctx if it is done before
+func (b *Bucket) Wait(ctx context.Context, n float64) error {
+	b.lock.Lock()
+	if b.rate <= 0 {
+		b.lock.Unlock()
+		return nil
+	}
+	b.refill(time.Now())
+	b.tokens -= n
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.lock.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Change the rate of the bucket while it is in use. A rate of 0 or less disables the limit
+func (b *Bucket) SetRate(rate float64, burst float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+	b.burst = burst
+	// debt from the old rate is forgiven, it would stall transfers after raising or lifting the limit
+	b.tokens = max(0, min(b.tokens, burst))
+	if rate <= 0 {
+		b.tokens = burst
+	}
+}
+
+// returns true if the bucket refilled completely, a full bucket behaves like a new one
+func (b *Bucket) full(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// Token buckets per key, e.g. per ip address
+type Limiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*Bucket
+	pruned  time.Time
+	lock    sync.Mutex
+}
+
+// Create a limiter that gives every key its own bucket. A rate of 0 or less disables the limit
+func NewLimiter(rate float64, burst float64) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+		pruned:  time.Now(),
+	}
+}
+
+// buckets of keys that were not seen for this long are full again and can be dropped
+const pruneInterval = time.Minute
+
+// Take a token from the bucket of the key if one is available
+func (l *Limiter) Allow(key string) bool {
+	return l.bucket(key).Allow()
+}
+
+// Take n tokens from the bucket of the key, see Bucket.Wait
+func (l *Limiter) Wait(ctx context.Context, key string, n float64) error {
+	return l.bucket(key).Wait(ctx, n)
+}
+
+// Change the rate of all keys while the limiter is in use. A rate of 0 or less disables the limit
+func (l *Limiter) SetRate(rate float64, burst float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = rate
+	l.burst = burst
+	for _, b := range l.buckets {
+		b.SetRate(rate, burst)
+	}
+}
+
+func (l *Limiter) bucket(key string) *Bucket {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if now.Sub(l.pruned) > pruneInterval {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Body of failed requests, the reference implementation answers with a message as well
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// Answer a request with the status code from the spec and a short reason the peer can show to its user
+func writeError(w http.ResponseWriter, status int, message string) {
+	buf, err := json.Marshal(errorResponse{Message: message})
+	if err != nil {
+		slog.Error("failed to marshal error response", slog.Any("error", err))
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/atomic-7/gocalsend/internal/ratelimit"
+)
+
+// the largest json body accepted, enough for sessions with thousands of files
+const maxJSONBody = 8 << 20
+
+// Requests per second a single peer can make. Uploads get their own limit, sending many small files takes many requests
+type Limits struct {
+	RequestRate float64
+	UploadRate  float64
+	// bandwidth of incoming file transfers, nil for no limit
+	Receive *ratelimit.Bandwidth
+	// bandwidth of shared files downloaded by peers, nil for no limit
+	Send *ratelimit.Bandwidth
+}
+
+// the bucket size of a limit, peers can send this many requests in a row before being slowed down
+func burst(rate float64) float64 {
+	return max(1, rate*4)
+}
+
+// Answer requests of peers that exceed the rate of the limiter with 429
+func limitRequests(limiter *ratelimit.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow(remoteIP(r).String()) {
+			slog.Debug("too many requests", slog.String("remote", r.RemoteAddr), slog.String("url", r.URL.Path))
+			writeError(w, 429, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Read a json request body of bounded size. Writes the error status to the response and returns false if reading failed
+func readBody(w http.ResponseWriter, r *http.Request, logga *slog.Logger) ([]byte, bool) {
+	buf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			logga.Error("request body too large", slog.String("remote", r.RemoteAddr), slog.Int64("limit", tooLarge.Limit))
+			writeError(w, 413, "Request body too large")
+			return nil, false
+		}
+		logga.Error("could not read request body", slog.Any("error", err))
+		writeError(w, 400, "Invalid body")
+		return nil, false
+	}
+	return buf, true
+}
@@ -2,18 +2,27 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/atomic-7/gocalsend/internal/data"
+	"github.com/atomic-7/gocalsend/internal/ratelimit"
 	"github.com/atomic-7/gocalsend/internal/sessions"
 )
 
@@ -21,7 +30,108 @@ func reqLogger(w http.ResponseWriter, r *http.Request) {
 	slog.Info("request", slog.Any("request", r))
 }
 
-func createPrepareUploadHandler(sman *sessions.SessionManager, peers data.PeerTracker) http.Handler {
+// check the pin supplied as url parameter against the pin of the local node. An empty pin disables the check
+func checkPin(r *http.Request, pin string) bool {
+	if pin == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("pin")), []byte(pin)) == 1
+}
+
+// returns the ip address of the remote end of the request
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// the address and, for https requests with a client certificate, the certificate fingerprint a request came from
+func requestOrigin(r *http.Request) sessions.Origin {
+	origin := sessions.Origin{IP: remoteIP(r)}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		origin.Fingerprint = hex.EncodeToString(sum[:])
+	}
+	return origin
+}
+
+// look up the peer a request originates from. Falls back to the info the peer sent along if it is not known yet
+func findPeer(r *http.Request, peers data.PeerTracker, info *data.PeerInfo) *data.PeerInfo {
+	ip := remoteIP(r)
+	pred := func(p *data.PeerInfo) bool {
+		return p.IP.Equal(ip)
+	}
+	if peer := peers.Find(pred); peer != nil {
+		return peer
+	}
+	if info != nil {
+		info.IP = ip
+	}
+	return info
+}
+
+// Parse the prepare payload of a request and ask the session manager to create a session for it.
+// Writes the error status to the response and returns nil if no session was created
+func prepareSession(w http.ResponseWriter, r *http.Request, sman *sessions.SessionManager, peers data.PeerTracker, logga *slog.Logger) *data.SessionInfo {
+	payload := &data.PreparePayload{
+		Files: make(map[string]*data.File),
+	}
+
+	buf, ok := readBody(w, r, logga)
+	if !ok {
+		return nil
+	}
+	err := json.Unmarshal(buf, payload)
+	if err != nil {
+		writeError(w, 400, "Invalid body")
+		logga.Error("could not unmarshal payload", slog.String("body", string(buf[:min(len(buf), 100)])), slog.Any("error", err))
+		return nil
+	}
+	// sessions and the ui rely on knowing who sent them
+	if payload.Info == nil {
+		writeError(w, 400, "Invalid body")
+		logga.Info("rejected session without peer info", slog.String("remote", r.RemoteAddr))
+		return nil
+	}
+
+	logga.Debug("incoming session", slog.Any("peer", payload.Info))
+	logga.Debug("session files", slog.Any("files", payload.Files))
+	peer := findPeer(r, peers, payload.Info)
+	sess, err := sman.CreateSession(peer, requestOrigin(r), payload.Files)
+	if err != nil {
+		switch {
+		case errors.Is(err, sessions.ErrFinished):
+			w.WriteHeader(204)
+			logga.Debug("session needs no file transfer")
+		case errors.Is(err, sessions.ErrTooManyOffers):
+			writeError(w, 429, err.Error())
+			logga.Info("too many pending session offers", slog.String("remote", r.RemoteAddr))
+		case errors.Is(err, sessions.ErrBlocked):
+			writeError(w, 409, err.Error())
+			logga.Info("blocked session while another session is active", slog.String("remote", r.RemoteAddr))
+		case errors.Is(err, sessions.ErrInvalidBody):
+			writeError(w, 400, err.Error())
+			logga.Info("rejected session with invalid payload", slog.String("remote", r.RemoteAddr))
+		case errors.Is(err, sessions.ErrTooLarge):
+			// the reason tells the sender which limit the session exceeds
+			writeError(w, 413, err.Error())
+		case errors.Is(err, sessions.ErrInsufficientStorage):
+			writeError(w, 507, err.Error())
+		default:
+			writeError(w, 403, "Rejected")
+			logga.Debug("user declined session")
+		}
+		return nil
+	}
+	for fid, tok := range sess.Files {
+		logga.Debug("[File]", slog.String("fileID", fid), slog.String("token", tok))
+	}
+	return sess
+}
+
+func createPrepareUploadHandler(sman *sessions.SessionManager, peers data.PeerTracker, pin string) http.Handler {
 	logga := slog.Default().With(slog.String("handler", "prepare upload"))
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 204 Finished, no file transfer needed
@@ -31,46 +141,54 @@ func createPrepareUploadHandler(sman *sessions.SessionManager, peers data.PeerTr
 		// 409 Blocked by another session
 		// 429 Too many requests
 		// 500 Server error
-		// TODO: Use ParseForm to get pin, it only reads the body when content-type is urlencoded
-		payload := &data.PreparePayload{
-			Files: make(map[string]*data.File),
+		// the pin is passed as url parameter, ParseForm would only read the body for urlencoded content
+		if !checkPin(r, pin) {
+			logga.Info("rejected session with missing or invalid pin", slog.String("remote", r.RemoteAddr))
+			writeError(w, 401, "Invalid pin")
+			return
+		}
+		sess := prepareSession(w, r, sman, peers, logga)
+		if sess == nil {
+			return
 		}
 
-		buf, err := io.ReadAll(r.Body)
+		resp, err := json.Marshal(sess)
 		if err != nil {
-			w.WriteHeader(500)
-			logga.Error("could not read request body", slog.Any("error", err))
+			writeError(w, 500, "Server error")
+			logga.Error("failed to marshal session", slog.Any("session", sess), slog.Any("error", err))
 			return
 		}
-		err = json.Unmarshal(buf, payload)
+		w.Header().Add("Content-Type", "application/json")
+		_, err = w.Write(resp)
 		if err != nil {
-			w.WriteHeader(500)
-			logga.Error("could not unmarshal payload", string(buf[0:100]), err)
+			logga.Error("failed to send the payload", slog.Any("error", err))
 			return
 		}
+	})
+}
 
-		logga.Debug("incoming session", slog.Any("peer", payload.Info))
-		logga.Debug("session files", slog.Any("files", payload.Files))
-		logga.Debug("Files to tokens")
-		// maybe track the client to which this session belongs?
-		// TODO: use session manager to check if the user wants to accept the incoming request
-		pred := func(p *data.PeerInfo) bool {
-			return p.IP.Equal(net.IP(r.RemoteAddr))
+// Protocol v1 equivalent of prepare-upload. The response only maps file ids to tokens, v1 has no session ids
+func createSendRequestHandler(sman *sessions.SessionManager, peers data.PeerTracker, pin string) http.Handler {
+	logga := slog.Default().With(slog.String("handler", "send request"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 401 Pin required
+		// 403 Rejected
+		// 409 Blocked by another session
+		// 500 Server error
+		if pin != "" {
+			// v1 has no way to pass a pin, the pin would be worthless if v1 peers could send anyway
+			logga.Info("rejected v1 session because a pin is required", slog.String("remote", r.RemoteAddr))
+			writeError(w, 401, "Pin required")
+			return
 		}
-		peer := peers.Find(pred)
-		sess := sman.CreateSession(peer, payload.Files)
+		sess := prepareSession(w, r, sman, peers, logga)
 		if sess == nil {
-			w.WriteHeader(403)
-			logga.Debug("user declined session")
 			return
 		}
-		for fid, tok := range sess.Files {
-			logga.Info("[File]", slog.String("fileID", fid), slog.String("token", tok))
-		}
 
-		resp, err := json.Marshal(sess)
+		resp, err := json.Marshal(sess.Files)
 		if err != nil {
-			w.WriteHeader(500)
+			writeError(w, 500, "Server error")
 			logga.Error("failed to marshal session", slog.Any("session", sess), slog.Any("error", err))
 			return
 		}
@@ -85,109 +203,360 @@ func createPrepareUploadHandler(sman *sessions.SessionManager, peers data.PeerTr
 
 func SessionReader(w http.ResponseWriter, r *http.Request) {
 
-	buf, err := io.ReadAll(r.Body)
-	if err != nil {
-		slog.Error("failed to read request body", slog.String("handler", "session reader"), slog.Any("error", err))
-		os.Exit(1)
+	buf, ok := readBody(w, r, slog.Default().With(slog.String("handler", "session reader")))
+	if !ok {
+		return
 	}
 
 	slog.Info("session raw string", slog.String("bytes", string(buf)))
 	//var sess *data.Session
 	sess := &data.SessionInfo{}
 	sess.Files = make(map[string]string)
-	err = json.Unmarshal(buf, sess)
+	err := json.Unmarshal(buf, sess)
 	if err != nil {
 		slog.Error("failed to unmarshal into session", slog.Any("error", err))
-		w.WriteHeader(400)
+		writeError(w, 400, "Invalid body")
 		return
 	}
 	slog.Info("received session", slog.String("id", sess.SessionID))
 	for fk, fv := range sess.Files {
-		slog.Info("[File]", slog.String("fileID", fk), slog.String("token", fv))
+		slog.Debug("[File]", slog.String("fileID", fk), slog.String("token", fv))
 	}
 	// Localsend Phone Client: type 'String' is not a subtype of type 'Map<String, dynamic>'
 }
 
-func createUploadHandler(sman *sessions.SessionManager) http.Handler {
+func createUploadHandler(sman *sessions.SessionManager, bandwidth *ratelimit.Bandwidth) http.Handler {
 	logga := slog.Default().With(slog.String("handler", "upload"))
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// 400 missing parameters
 		// 403 invalid token or ip addr
 		// 409 blocked by another session
 		// 500 Server error
-		r.ParseForm()
+		// ParseForm would consume the body of uploads sent as urlencoded form, only the query is needed
+		query := r.URL.Query()
 		// TODO: Check for malicious url parameters
-		// TODO: Use http.Error instead of write header for better feedback for requests
-		if !r.Form.Has("sessionId") || !r.Form.Has("fileId") || !r.Form.Has("token") {
+		if !query.Has("sessionId") || !query.Has("fileId") || !query.Has("token") {
 			logga.Error("request with invalid url parameters", slog.String("url", r.URL.String()))
 			slog.Debug("expected parameters",
-				slog.String("sessionId", r.Form.Get("sessionId")),
-				slog.String("fileId", r.Form.Get("fileId")),
-				slog.String("tokekn", r.Form.Get("token")),
+				slog.String("sessionId", query.Get("sessionId")),
+				slog.String("fileId", query.Get("fileId")),
+				slog.String("tokekn", query.Get("token")),
 			)
-			w.WriteHeader(400)
+			writeError(w, 400, "Missing parameters")
 			return
 		}
-		sessID := r.Form.Get("sessionId")
-		fileID := r.Form.Get("fileId")
-		token := r.Form.Get("token")
-		if _, ok := sman.Downloads[sessID]; !ok {
+		sessID := query.Get("sessionId")
+		fileID := query.Get("fileId")
+		token := query.Get("token")
+		// an upload from a peer is a download to the local node
+		sess, ok := sman.Download(sessID)
+		if !ok {
 			logga.Error("invalid session", slog.String("sessionId", sessID))
-			w.WriteHeader(403)
+			if sman.Busy() {
+				// the spec answers uploads for unknown sessions with blocked while another session is active
+				writeError(w, 409, "Blocked by another session")
+				return
+			}
+			writeError(w, 403, "Invalid session id")
+			return
+		}
+		if !sess.Origin.Matches(requestOrigin(r)) {
+			logga.Error("upload from a peer that does not own the session", slog.String("sessionId", sessID), slog.String("remote", r.RemoteAddr))
+			writeError(w, 403, "Invalid token or IP address")
 			return
 		}
-		// an upload from a peer is a download to the local node
-		sess := sman.Downloads[sessID]
-		// TODO: Check if the sending peer is associated with this session in the session manager
 		if _, ok := sess.Files[fileID]; !ok {
 			logga.Error("invalid fileid", slog.String("fileId", fileID))
-			w.WriteHeader(403)
+			writeError(w, 403, "Invalid file id")
 			return
 		}
 		file := sess.Files[fileID]
-		if file.Token != token {
-			logga.Error("valid session and id with invalid token", slog.String("file token", file.Token), slog.String("url token", token))
-			w.WriteHeader(500)
+		if !sessions.ValidToken(file.Token, token) {
+			logga.Error("valid session and id with invalid token", slog.String("sessionId", sessID), slog.String("fileId", fileID))
+			writeError(w, 403, "Invalid token or IP address")
 			return
 		}
-		path := sman.BasePath
-		if file.Destination != "" {
-			path = file.Destination
-			// TODO: Create potentially missing folders
-		}
-		logga.Debug("dl path", slog.String("path", path), slog.String("name", file.FileName), slog.String("dest", file.Destination))
+		receiveFile(w, r, sman, bandwidth, sess, fileID, logga)
+	})
+}
 
-		err := os.MkdirAll(path, os.ModePerm)
-		if err != nil {
-			logga.Error("failed to create output directory", slog.String("out", path))
+// Protocol v1 equivalent of the upload route. Without session ids the session is found via file id and token
+func createSendHandler(sman *sessions.SessionManager, bandwidth *ratelimit.Bandwidth) http.Handler {
+	logga := slog.Default().With(slog.String("handler", "send"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 400 missing parameters
+		// 403 invalid token or ip addr
+		// 409 blocked by another session
+		// 500 Server error
+		query := r.URL.Query()
+		if !query.Has("fileId") || !query.Has("token") {
+			logga.Error("request with invalid url parameters", slog.String("url", r.URL.String()))
+			writeError(w, 400, "Missing parameters")
+			return
+		}
+		fileID := query.Get("fileId")
+		sess := sman.FindDownload(fileID, query.Get("token"))
+		if sess == nil {
+			logga.Error("no session for file id and token", slog.String("fileId", fileID))
+			writeError(w, 403, "Invalid token or IP address")
+			return
+		}
+		if !sess.Origin.Matches(requestOrigin(r)) {
+			logga.Error("upload from a peer that does not own the session", slog.String("sessionId", sess.SessionID), slog.String("remote", r.RemoteAddr))
+			writeError(w, 403, "Invalid token or IP address")
+			return
 		}
+		receiveFile(w, r, sman, bandwidth, sess, fileID, logga)
+	})
+}
 
-		osFile, err := os.Create(filepath.Join(path, file.FileName))
-		defer osFile.Close()
-		if err != nil {
-			logga.Error("failed to create file ", slog.String("file", path+"/"+file.FileName), slog.Any("error", err))
-			w.WriteHeader(500)
+// parse the start offset from a content range header of the form "bytes <start>-<end>/<size>". An empty header starts at 0
+func parseContentRange(header string) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	var start, end, size int64
+	_, err := fmt.Sscanf(header, "bytes %d-%d/%d", &start, &end, &size)
+	if err != nil {
+		return 0, err
+	}
+	if start < 0 || start > size {
+		return 0, fmt.Errorf("invalid range start %d for size %d", start, size)
+	}
+	return start, nil
+}
+
+// A reader that fails once its session is done. Arriving data keeps the session from timing out
+type sessionReader struct {
+	sess *sessions.Session
+	r    io.Reader
+}
+
+func (sr *sessionReader) Read(p []byte) (int, error) {
+	if err := sr.sess.GetCtx().Err(); err != nil {
+		return 0, err
+	}
+	n, err := sr.r.Read(p)
+	if n > 0 {
+		sr.sess.Touch()
+	}
+	return n, err
+}
+
+// returns the number of bytes already received for a partial file
+func partialSize(partial string) int64 {
+	info, err := os.Stat(partial)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// Write the request body to the file of the session.
+// HEAD requests report how much of the file was already received, a Content-Range header resumes the upload at that offset
+func receiveFile(w http.ResponseWriter, r *http.Request, sman *sessions.SessionManager, bandwidth *ratelimit.Bandwidth, sess *sessions.Session, fileID string, logga *slog.Logger) {
+	file := sess.Files[fileID]
+	// the session manager resolved the target path inside the download folder when creating the session
+	target := file.Destination
+	logga.Debug("dl path", slog.String("name", file.FileName), slog.String("dest", target))
+	partial := sessions.PartialPath(target)
+	// offset queries of a sender that resumes count as activity as well
+	sess.Touch()
+	if r.Method == http.MethodHead {
+		w.Header().Set(data.ResumeOffsetHeader, strconv.FormatInt(partialSize(partial), 10))
+		return
+	}
+	// a stale upload that is still draining and the retry of the sender would interleave their bytes in the partial file
+	if !sess.StartWriting(fileID) {
+		logga.Info("file is already being received", slog.String("sessionId", sess.SessionID), slog.String("file", file.FileName))
+		writeError(w, 409, "File is already being received")
+		return
+	}
+	defer sess.StopWriting(fileID)
+
+	offset, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err == nil && offset > file.Size {
+		err = fmt.Errorf("offset %d is past the end of the file", offset)
+	}
+	if err != nil {
+		logga.Error("invalid content range", slog.String("range", r.Header.Get("Content-Range")), slog.Any("error", err))
+		writeError(w, 400, "Invalid content range")
+		return
+	}
+
+	// checked before creating directories, a symlink swapped in after accepting the session must not get any created outside
+	if err = sman.Confine(target); err != nil {
+		logga.Error("refusing to write outside of the download folder", slog.String("target", target), slog.Any("error", err))
+		writeError(w, 403, "Target is outside of the download folder")
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		logga.Error("failed to create output directory", slog.String("out", filepath.Dir(target)), slog.Any("error", err))
+		writeError(w, 500, "Failed to store file")
+		return
+	}
+
+	// hash while writing so the file does not have to be read again for verification
+	hasher := sha256.New()
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		if received := partialSize(partial); received != offset {
+			// the sender has to continue where the partial file actually ends
+			logga.Error("resume offset does not match partial file", slog.String("file", file.FileName), slog.Int64("offset", offset), slog.Int64("received", received))
+			w.Header().Set(data.ResumeOffsetHeader, strconv.FormatInt(received, 10))
+			writeError(w, 416, "Resume offset does not match the received data")
 			return
 		}
+		// the part received earlier is needed for the checksum as well
+		if file.Sha256 != "" {
+			err = hashPartial(hasher, partial)
+			if err != nil {
+				logga.Error("failed to hash partial file", slog.String("file", partial), slog.Any("error", err))
+				writeError(w, 500, "Failed to store file")
+				return
+			}
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+		logga.Info("resuming upload", slog.String("file", file.FileName), slog.Int64("offset", offset))
+	}
+
+	osFile, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		logga.Error("failed to create file ", slog.String("file", partial), slog.Any("error", err))
+		writeError(w, 500, "Failed to store file")
+		return
+	}
+	defer osFile.Close()
 
-		_, err = osFile.ReadFrom(r.Body) // could probably also use io.Copy
+	// cancelling the session stops the copy. The read deadline unblocks a read that waits for a stalled peer
+	ctx := sess.GetCtx()
+	rc := http.NewResponseController(w)
+	deadlineSet := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		rc.SetReadDeadline(time.Now())
+		close(deadlineSet)
+	})
+	// one byte more than the declared size is enough to tell that the peer sends too much, the rest is never written
+	missing := file.Size - offset
+	body := bandwidth.Reader(ctx, remoteIP(r).String(), io.LimitReader(&sessionReader{sess: sess, r: r.Body}, missing+1))
+	body = sman.TrackProgress(sess.SessionID, file, offset, body)
+	written, err := io.Copy(io.MultiWriter(osFile, hasher), body)
+	if !stop() {
+		// the response writer must not be used after the handler returns
+		<-deadlineSet
+	}
+	if err == nil && written > missing {
+		logga.Error("peer sent more than the declared size", slog.String("file", file.FileName), slog.Int64("expected", file.Size))
+		osFile.Close()
+		err = os.Remove(partial)
 		if err != nil {
-			logga.Error("failed to write to file", slog.String("file", file.FileName), slog.Any("error", err))
-			w.WriteHeader(500)
+			logga.Error("failed to remove oversized file", slog.String("file", partial), slog.Any("error", err))
+		}
+		reason := fmt.Errorf("size mismatch: expected %d bytes, got more", file.Size)
+		sman.FailFile(sess.SessionID, fileID, reason)
+		writeError(w, 400, reason.Error())
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// the partial file can not be resumed without the session
+			logga.Info("session cancelled during upload", slog.String("sessionId", sess.SessionID), slog.String("file", file.FileName))
+			osFile.Close()
+			err = os.Remove(partial)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				logga.Error("failed to remove incomplete file", slog.String("file", partial), slog.Any("error", err))
+			}
+			writeError(w, 403, "Session cancelled")
 			return
 		}
+		// the partial file is kept so the sender can resume
+		logga.Error("failed to write to file", slog.String("file", file.FileName), slog.Any("error", err))
+		writeError(w, 500, "Failed to store file")
+		return
+	}
+	// the data has to be on disk before the file appears under its final name
+	err = osFile.Sync()
+	if err != nil {
+		logga.Error("failed to sync file", slog.String("file", file.FileName), slog.Any("error", err))
+		writeError(w, 500, "Failed to store file")
+		return
+	}
+
+	// Not a deferred close to be able to catch errors that might happen when closing a file after writing
+	err = osFile.Close()
+	if err != nil {
+		logga.Error("failed to close file", slog.String("file", file.FileName), slog.Any("error", err))
+		writeError(w, 500, "Failed to store file")
+		return
+	}
 
-		// Not a deferred close to be able to catch errors that might happen when closing a file after writing
-		err = osFile.Close()
+	if received := offset + written; received != file.Size {
+		logga.Error("size mismatch", slog.String("file", file.FileName), slog.Int64("expected", file.Size), slog.Int64("actual", received))
+		err = os.Remove(partial)
 		if err != nil {
-			logga.Error("failed to close file", slog.String("file", file.FileName), slog.Any("error", err))
-			w.WriteHeader(500)
+			logga.Error("failed to remove incomplete file", slog.String("file", partial), slog.Any("error", err))
+		}
+		reason := fmt.Errorf("size mismatch: expected %d bytes, got %d", file.Size, received)
+		sman.FailFile(sess.SessionID, fileID, reason)
+		writeError(w, 400, reason.Error())
+		return
+	}
+
+	if file.Sha256 != "" {
+		checksum := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(checksum, file.Sha256) {
+			logga.Error("checksum mismatch", slog.String("file", file.FileName), slog.String("expected", file.Sha256), slog.String("actual", checksum))
+			err = os.Remove(partial)
+			if err != nil {
+				logga.Error("failed to remove corrupted file", slog.String("file", partial), slog.Any("error", err))
+			}
+			reason := fmt.Errorf("sha256 mismatch: expected %s, got %s", file.Sha256, checksum)
+			sman.FailFile(sess.SessionID, fileID, reason)
+			writeError(w, 400, reason.Error())
 			return
 		}
+	}
 
-		logga.Info("file downloaded", slog.String("sessionId", sess.SessionID), slog.String("file", file.FileName), slog.String("path", path))
-		sman.FinishFile(sess.SessionID, fileID)
-	})
+	err = os.Rename(partial, target)
+	if err != nil {
+		logga.Error("failed to move file into place", slog.String("file", target), slog.Any("error", err))
+		writeError(w, 500, "Failed to store file")
+		return
+	}
+	if sman.KeepFileTimes {
+		applyTimes(target, file.Metadata, logga)
+	}
+
+	logga.Info("file downloaded", slog.String("sessionId", sess.SessionID), slog.String("file", file.FileName), slog.String("path", target))
+	sman.FinishFile(sess.SessionID, fileID)
+}
+
+// Set the modification and access time the sender reported for a received file.
+// Both times are optional, a missing access time is replaced by the modification time
+func applyTimes(target string, meta *data.MetaData, logga *slog.Logger) {
+	if meta == nil || meta.Modified.IsZero() {
+		return
+	}
+	accessed := meta.Accessed
+	if accessed.IsZero() {
+		accessed = meta.Modified
+	}
+	err := os.Chtimes(target, accessed, meta.Modified)
+	if err != nil {
+		// the file itself is fine, so this does not fail the transfer
+		logga.Error("failed to apply file times", slog.String("file", target), slog.Any("error", err))
+	}
+}
+
+func hashPartial(hasher io.Writer, partial string) error {
+	fh, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(hasher, fh)
+	return err
 }
 
 func createCancelHandler(sman *sessions.SessionManager) http.Handler {
@@ -195,21 +564,156 @@ func createCancelHandler(sman *sessions.SessionManager) http.Handler {
 		err := r.ParseForm()
 		if err != nil {
 			slog.Error("failed to parse query parameters for cancel request", slog.Any("error", err), slog.String("handler", "cancel"))
-			w.WriteHeader(500)
+			writeError(w, 400, "Invalid parameters")
 			return
 		}
-		if !r.Form.Has("sessionId") { // It seems that the reference implementation does not send a sessionId to cancel?
-			slog.Error("cancel request without session id")
-			slog.Debug("cancel query", slog.String("url", r.URL.String()), slog.String("handler", "cancel"))
-			w.WriteHeader(400)
+		if !r.Form.Has("sessionId") {
+			// the reference implementation does not send a session id, it cancels the active session of the peer
+			ip := remoteIP(r)
+			n := sman.CancelPeerSessions(ip)
+			slog.Debug("cancelled sessions of peer", slog.Any("ip", ip), slog.Int("sessions", n), slog.String("handler", "cancel"))
 			return
 		}
 		sessID := r.Form.Get("sessionId")
+		sess, ok := sman.Download(sessID)
+		if !ok {
+			sess, ok = sman.Share(sessID)
+		}
+		if ok && !sess.Origin.Matches(requestOrigin(r)) {
+			slog.Error("cancel from a peer that does not own the session", slog.String("sessionId", sessID), slog.String("remote", r.RemoteAddr), slog.String("handler", "cancel"))
+			writeError(w, 403, "Invalid token or IP address")
+			return
+		}
 		sman.CancelSession(sessID)
 		slog.Debug("cancelled session", slog.String("id", sessID))
 	})
 }
 
+// Protocol v1 cancel requests carry no session id, so every session of the requesting peer is cancelled
+func createCancelV1Handler(sman *sessions.SessionManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		n := sman.CancelPeerSessions(ip)
+		slog.Debug("cancelled sessions of peer", slog.Any("ip", ip), slog.Int("sessions", n), slog.String("handler", "cancel v1"))
+	})
+}
+
+func createPrepareDownloadHandler(localNode *data.PeerInfo, sman *sessions.SessionManager, pin string) http.Handler {
+	logga := slog.Default().With(slog.String("handler", "prepare download"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 401 Pin required / invalid pin
+		// 403 Rejected
+		// 429 Too many requests
+		// 500 Server error
+		if !checkPin(r, pin) {
+			logga.Info("rejected download with missing or invalid pin", slog.String("remote", r.RemoteAddr))
+			writeError(w, 401, "Invalid pin")
+			return
+		}
+		// the session id is optional, an unknown or missing id creates a new share session
+		sess := sman.GetShare(nil, requestOrigin(r), r.URL.Query().Get("sessionId"))
+		if sess == nil {
+			logga.Debug("download requested but no files are shared", slog.String("remote", r.RemoteAddr))
+			writeError(w, 403, "Rejected")
+			return
+		}
+		resp, err := json.Marshal(&data.PrepareDownloadResponse{
+			Info:      localNode.ToRegisterResponse(),
+			SessionID: sess.SessionID,
+			Files:     sess.Files,
+		})
+		if err != nil {
+			writeError(w, 500, "Server error")
+			logga.Error("failed to marshal share session", slog.String("sessionId", sess.SessionID), slog.Any("error", err))
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		_, err = w.Write(resp)
+		if err != nil {
+			logga.Error("failed to send the payload", slog.Any("error", err))
+		}
+	})
+}
+
+func createDownloadHandler(sman *sessions.SessionManager, bandwidth *ratelimit.Bandwidth) http.Handler {
+	logga := slog.Default().With(slog.String("handler", "download"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 400 missing parameters
+		// 403 invalid session or file id
+		// 500 Server error
+		query := r.URL.Query()
+		if !query.Has("sessionId") || !query.Has("fileId") {
+			logga.Error("request with invalid url parameters", slog.String("url", r.URL.String()))
+			writeError(w, 400, "Missing parameters")
+			return
+		}
+		sessID := query.Get("sessionId")
+		fileID := query.Get("fileId")
+		sess, ok := sman.Share(sessID)
+		if !ok {
+			logga.Error("invalid session", slog.String("sessionId", sessID))
+			writeError(w, 403, "Invalid session id")
+			return
+		}
+		if !sess.Origin.Matches(requestOrigin(r)) {
+			logga.Error("download from a peer that does not own the session", slog.String("sessionId", sessID), slog.String("remote", r.RemoteAddr))
+			writeError(w, 403, "Invalid session id")
+			return
+		}
+		file, ok := sess.Files[fileID]
+		if !ok {
+			logga.Error("invalid fileid", slog.String("fileId", fileID))
+			writeError(w, 403, "Invalid file id")
+			return
+		}
+		fh, err := os.Open(file.Destination)
+		if err != nil {
+			logga.Error("failed to open shared file", slog.String("file", file.Destination), slog.Any("error", err))
+			writeError(w, 500, "Failed to open file")
+			return
+		}
+		defer fh.Close()
+		modTime := time.Time{}
+		if file.Metadata != nil {
+			modTime = file.Metadata.Modified
+		}
+		if file.FileType != "" {
+			w.Header().Set("Content-Type", file.FileType)
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.FileName}))
+		// ServeContent takes care of range requests so interrupted browser downloads can be resumed
+		cw := &countingWriter{ResponseWriter: w}
+		// seeking the file directly is fine, the throttled reader does not buffer
+		content := &throttledFile{Reader: bandwidth.Reader(r.Context(), remoteIP(r).String(), fh), Seeker: fh}
+		http.ServeContent(cw, r, file.FileName, modTime, content)
+		// aborted downloads and parts of range requests do not count, the share session stays for them to be resumed
+		if r.Method != http.MethodGet || cw.written != file.Size {
+			logga.Debug("file partially served", slog.String("sessionId", sessID), slog.String("file", file.FileName), slog.Int64("bytes", cw.written))
+			return
+		}
+		logga.Info("file served", slog.String("sessionId", sessID), slog.String("file", file.FileName))
+		sman.FinishSharedFile(sessID, fileID)
+	})
+}
+
+// a shared file that is read through the bandwidth limit
+type throttledFile struct {
+	io.Reader
+	io.Seeker
+}
+
+// counts the bytes of the response body
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
 func createInfoHandler(nodeJson []byte) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// apparently the localsend implementation expects some response here? https://github.com/localsend/localsend/blob/main/common/lib/src/discovery/http_target_discovery.dart
@@ -229,27 +733,29 @@ func createInfoHandler(nodeJson []byte) http.Handler {
 }
 
 // Registry seems to work when encryption is turned of for the peer, but not when active
-func createRegisterHandler(localNode *data.PeerInfo, peers data.PeerTracker) http.Handler {
+func createRegisterHandler(regResp []byte, peers data.PeerTracker) http.Handler {
 	logga := slog.Default().With(slog.String("handler", "register"))
-	regResp, err := json.Marshal(localNode.ToRegisterResponse())
-	if err != nil {
-		logga.Error("Could not marshal local node for response to register handler: ", err)
-		os.Exit(1)
-	}
-	return http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 400 Invalid body
+		// 429 Too many requests
+		// 500 Server error
 		logga.Debug("incoming registry via api", slog.String("url", r.URL.String()))
-		buf, err := io.ReadAll(r.Body)
-		if err != nil {
-			logga.Error("failed to read request body", slog.Any("error", err))
-			os.Exit(1)
+		buf, ok := readBody(w, r, logga)
+		if !ok {
+			return
 		}
 		var peer data.PeerInfo
-		json.Unmarshal(buf, &peer)
-		parts := strings.Split(r.RemoteAddr, ":")
-		peer.IP = net.ParseIP(parts[0])
+		err := json.Unmarshal(buf, &peer)
+		if err != nil {
+			logga.Error("could not unmarshal peer", slog.String("remote", r.RemoteAddr), slog.Any("error", err))
+			writeError(w, 400, "Invalid body")
+			return
+		}
+		peer.IP = remoteIP(r)
 		if peer.IP == nil {
-			logga.Error("failed to parse peer ip", slog.Any("host", r.Host))
-			os.Exit(1)
+			logga.Error("failed to parse peer ip", slog.String("remote", r.RemoteAddr))
+			writeError(w, 500, "Server error")
+			return
 		}
 		// TODO: maybe reuse the registratinator here?
 		if peers.Add(&peer) {
@@ -257,62 +763,144 @@ func createRegisterHandler(localNode *data.PeerInfo, peers data.PeerTracker) htt
 		} else {
 			logga.Debug("peer was already known", slog.String("peer", peer.Alias))
 		}
-		writer.Write(regResp)
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(regResp)
 	})
 }
 
-func StartServer(ctx context.Context, localNode *data.PeerInfo, peers data.PeerTracker, sessionManager *sessions.SessionManager, tlsInfo *data.TLSPaths, downloadBase string) {
+// The http api of the local node. It can be stopped with Shutdown and started again
+type Server struct {
+	node     *data.PeerInfo
+	sessions *sessions.SessionManager
+	tlsInfo  *data.TLSPaths
+	handler  http.Handler
+	lock     sync.Mutex
+	srv      *http.Server
+	// set by Shutdown, the server does not start anymore afterwards
+	closed bool
+}
 
+// Set up the api routes. Pass a nil tlsInfo to serve plain http
+func New(localNode *data.PeerInfo, peers data.PeerTracker, sessionManager *sessions.SessionManager, tlsInfo *data.TLSPaths, pin string, limits Limits) (*Server, error) {
 	if peers == nil {
-		slog.Error("failed to setup server", slog.String("reason", "peertracker is nil"))
-		os.Exit(1)
+		return nil, errors.New("peertracker is nil")
 	}
 	jsonBuf, err := json.Marshal(localNode.ToPeerBody())
 	if err != nil {
-		slog.Error("failed to unmarshal local node to json", slog.Any("error", err))
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to marshal local node to json: %w", err)
 	}
 	slog.Debug("NodeJson", slog.String("json", string(jsonBuf)))
+	regResp, err := json.Marshal(localNode.ToRegisterResponse())
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal register response: %w", err)
+	}
 
 	infoHandler := createInfoHandler(jsonBuf)
-	prepUploadHandler := createPrepareUploadHandler(sessionManager, peers)
-	uploadHandler := createUploadHandler(sessionManager)
-	cancelHandler := createCancelHandler(sessionManager)
+	// every peer gets its own budget, one misbehaving peer should not lock out the others
+	apiLimiter := ratelimit.NewLimiter(limits.RequestRate, burst(limits.RequestRate))
+	uploadLimiter := ratelimit.NewLimiter(limits.UploadRate, burst(limits.UploadRate))
+	api := func(h http.Handler) http.Handler {
+		return limitRequests(apiLimiter, h)
+	}
+	upload := func(h http.Handler) http.Handler {
+		return limitRequests(uploadLimiter, h)
+	}
 	mux := http.NewServeMux()
-	mux.Handle("/api/localsend/v2/register", createRegisterHandler(localNode, peers))
+	mux.Handle("/api/localsend/v2/register", api(createRegisterHandler(regResp, peers)))
 	mux.Handle("/api/localsend/v1/info", infoHandler)
 	mux.Handle("/api/localsend/v2/info", infoHandler)
-	mux.Handle("/api/localsend/v2/prepare-upload", prepUploadHandler)
-	mux.Handle("/api/localsend/v1/upload", uploadHandler)
-	mux.Handle("/api/localsend/v2/upload", uploadHandler)
-	mux.Handle("/api/localsend/v2/cancel", cancelHandler)
+	mux.Handle("/api/localsend/v2/prepare-upload", api(createPrepareUploadHandler(sessionManager, peers, pin)))
+	mux.Handle("/api/localsend/v1/send-request", api(createSendRequestHandler(sessionManager, peers, pin)))
+	mux.Handle("/api/localsend/v1/send", upload(createSendHandler(sessionManager, limits.Receive)))
+	mux.Handle("/api/localsend/v1/cancel", api(createCancelV1Handler(sessionManager)))
+	mux.Handle("/api/localsend/v2/upload", upload(createUploadHandler(sessionManager, limits.Receive)))
+	mux.Handle("/api/localsend/v2/cancel", api(createCancelHandler(sessionManager)))
+	mux.Handle("/api/localsend/v2/prepare-download", api(createPrepareDownloadHandler(localNode, sessionManager, pin)))
+	mux.Handle("/api/localsend/v2/download", upload(createDownloadHandler(sessionManager, limits.Send)))
 	mux.HandleFunc("/testing/sessions", SessionReader)
-	mux.HandleFunc("/", reqLogger)
+	mux.Handle("/", createWebShareHandler(sessionManager))
 
-	var srv http.Server
-	port := fmt.Sprintf(":%d", localNode.Port)
-	slog.Info("server started", slog.Int("port", localNode.Port), slog.String("protocol", localNode.Protocol))
+	return &Server{
+		node:     localNode,
+		sessions: sessionManager,
+		tlsInfo:  tlsInfo,
+		handler:  mux,
+	}, nil
+}
 
-	// Might have to use InsecureSkipVerify here with a VerifyConnection function to check against the known fingerprints?
-	// TODO: Look into VerifyConnection
+// Serve the api until Shutdown is called. Returns nil after a shutdown, any other error means the server could not run
+func (s *Server) Start() error {
+	s.lock.Lock()
+	if s.closed {
+		// shut down before it got to start, e.g. by a signal during setup
+		s.lock.Unlock()
+		return nil
+	}
+	if s.srv != nil {
+		s.lock.Unlock()
+		return errors.New("server is already running")
+	}
+	// a start that failed to listen can be retried, every start gets a fresh http.Server
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.node.Port),
+		Handler: s.handler,
+	}
 	// TODO: ErrorLog
-	if tlsInfo != nil {
+	if s.tlsInfo != nil {
+		// Might have to use InsecureSkipVerify here with a VerifyConnection function to check against the known fingerprints?
+		// TODO: Look into VerifyConnection
+		srv.TLSConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: true,
+			// peers use self signed certificates, they are only requested to tie sessions to the peer that created them
+			ClientAuth: tls.RequestClientCert,
+		}
+	}
+	s.srv = srv
+	s.lock.Unlock()
+
+	// leftovers of transfers that were interrupted by a previous shutdown
+	s.sessions.RemovePartials()
+	slog.Info("server started", slog.Int("port", s.node.Port), slog.String("protocol", s.node.Protocol))
+	var err error
+	if s.tlsInfo != nil {
 		slog.Debug("setting up https api")
-		srv = http.Server{
-			Addr:    port,
-			Handler: mux,
-			TLSConfig: &tls.Config{
-				MinVersion:         tls.VersionTLS12,
-				InsecureSkipVerify: true,
-			},
-		}
-		slog.Error("server error", slog.Any("error", srv.ListenAndServeTLS(tlsInfo.Cert, tlsInfo.Key)))
-		os.Exit(1)
+		err = srv.ListenAndServeTLS(s.tlsInfo.Cert, s.tlsInfo.Key)
 	} else {
-		srv = http.Server{
-			Addr:    port,
-			Handler: mux,
-		}
-		slog.Error("server error", slog.Any("error", srv.ListenAndServe()))
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	// the server never ran, allow starting it again
+	s.lock.Lock()
+	if s.srv == srv {
+		s.srv = nil
+	}
+	s.lock.Unlock()
+	return err
+}
+
+// Stop accepting requests and let running transfers finish until ctx is done.
+// Offers are rejected right away, sessions that are still open afterwards are cancelled and their connections closed.
+// The server can not be started again afterwards, a Start that races with the shutdown returns without serving
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	srv := s.srv
+	s.srv = nil
+	s.closed = true
+	s.lock.Unlock()
+	if srv == nil {
+		return nil
+	}
+	slog.Info("shutting down server")
+	// nobody is going to answer them anymore and the handlers waiting for an answer would hold up the shutdown
+	s.sessions.CancelOffers()
+	err := srv.Shutdown(ctx)
+	// cancelling aborts the uploads that did not finish in time and removes their partial files
+	s.sessions.CancelIncoming()
+	if err != nil {
+		return errors.Join(err, srv.Close())
 	}
+	return nil
 }
@@ -0,0 +1,34 @@
+package server
+
+import (
+	_ "embed"
+	"log/slog"
+	"net/http"
+
+	"github.com/atomic-7/gocalsend/internal/sessions"
+)
+
+// Page for browsers to download shared files, works like the web share of the reference implementation
+//
+//go:embed web/index.html
+var webSharePage []byte
+
+// Serves the web share page at the root while files are shared. All other requests are only logged
+func createWebShareHandler(sman *sessions.SessionManager) http.Handler {
+	logga := slog.Default().With(slog.String("handler", "web share"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || !sman.IsSharing() {
+			reqLogger(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(405)
+			return
+		}
+		logga.Debug("serving web share page", slog.String("remote", r.RemoteAddr))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Write(webSharePage)
+	})
+}
@@ -0,0 +1,117 @@
+package sessions
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/atomic-7/gocalsend/internal/data"
+)
+
+// What happens to received files whose name is already taken in the download folder
+type ConflictPolicy string
+
+const (
+	// save the file as "name (1).ext"
+	ConflictRename ConflictPolicy = "rename"
+	// replace the existing file
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// keep the existing file and leave the file out of the session
+	ConflictSkip ConflictPolicy = "skip"
+	// let the user decide when accepting the session. Uis that can not ask fall back to rename
+	ConflictAsk ConflictPolicy = "ask"
+)
+
+// Parse the conflict policy of the config. Unknown names are an error, a typo would otherwise behave like rename
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	policy := ConflictPolicy(name)
+	switch policy {
+	case ConflictRename, ConflictOverwrite, ConflictSkip, ConflictAsk:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, use rename, overwrite, skip or ask", name)
+}
+
+// Returns the ids of files that would replace existing files or files of other running sessions
+func (sm *SessionManager) findConflicts(files map[string]*data.File) []string {
+	claimed := sm.claimedPaths()
+	conflicts := make([]string, 0)
+	for fileID, file := range files {
+		if claimed[file.Destination] || exists(file.Destination) {
+			conflicts = append(conflicts, fileID)
+		}
+	}
+	slices.Sort(conflicts)
+	return conflicts
+}
+
+// Decide the final names of the session files. Files of the same session never collide, regardless of the policy.
+// Skipped files are removed from the session. Has to be called with dlLock held, so that sessions
+// created at the same time can not claim the same names
+func (sm *SessionManager) resolveConflicts(sess *Session, info *data.SessionInfo, policy ConflictPolicy) {
+	claimed := sm.claimedPaths()
+	// sorted so the renaming is stable for the same set of files
+	ids := make([]string, 0, len(sess.Files))
+	for fileID := range sess.Files {
+		ids = append(ids, fileID)
+	}
+	slices.Sort(ids)
+	for _, fileID := range ids {
+		file := sess.Files[fileID]
+		taken := exists(file.Destination)
+		if claimed[file.Destination] || (taken && policy != ConflictOverwrite) {
+			if policy == ConflictSkip && !claimed[file.Destination] {
+				slog.Info("skipping existing file", slog.String("file", file.FileName))
+				delete(sess.Files, fileID)
+				delete(info.Files, fileID)
+				sess.Remaining -= 1
+				continue
+			}
+			file.FileName = sm.freeName(file.FileName, claimed)
+			file.Destination = filepath.Join(sm.BasePath, filepath.FromSlash(file.FileName))
+			slog.Info("renamed file to avoid a conflict", slog.String("file", file.FileName))
+		}
+		// the temporary name is written to while the file is received, no other file may end up there
+		claimed[file.Destination] = true
+		claimed[PartialPath(file.Destination)] = true
+	}
+}
+
+// Find the first name in the form of "name (n).ext" that is neither claimed nor exists
+func (sm *SessionManager) freeName(fileName string, claimed map[string]bool) string {
+	dir, base := path.Split(fileName)
+	ext := path.Ext(base)
+	// dot files like .bashrc have no extension
+	if ext == base {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(base, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s%s (%d)%s", dir, stem, n, ext)
+		dest := filepath.Join(sm.BasePath, filepath.FromSlash(candidate))
+		if !claimed[dest] && !exists(dest) {
+			return candidate
+		}
+	}
+}
+
+// Paths of the files of all running download sessions and their partial files. Has to be called with dlLock held
+func (sm *SessionManager) claimedPaths() map[string]bool {
+	claimed := make(map[string]bool)
+	for _, sess := range sm.Downloads {
+		for _, file := range sess.Files {
+			claimed[file.Destination] = true
+			claimed[PartialPath(file.Destination)] = true
+		}
+	}
+	return claimed
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
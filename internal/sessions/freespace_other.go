@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package sessions
+
+import (
+	"errors"
+)
+
+// the free space can not be determined on this platform, sessions are only checked against the configured limits
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package sessions
+
+import (
+	"syscall"
+)
+
+// returns the number of bytes available to unprivileged users on the volume of the directory
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	// the field types differ between platforms
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
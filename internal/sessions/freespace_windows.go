@@ -0,0 +1,20 @@
+//go:build windows
+
+package sessions
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// returns the number of bytes available to the current user on the volume of the directory
+func freeSpace(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
@@ -0,0 +1,83 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/atomic-7/gocalsend/internal/data"
+)
+
+var (
+	// the session or one of its files exceeds the configured size limits
+	ErrTooLarge = errors.New("Too large")
+	// the download folder does not have enough free space for the session
+	ErrInsufficientStorage = errors.New("Insufficient storage")
+)
+
+// Check the declared sizes of the offered files against the configured limits and the free space of the download folder.
+// Has to be called with dlLock held
+func (sm *SessionManager) checkLimits(files map[string]*data.File) error {
+	var total uint64
+	for _, file := range files {
+		if file.Size < 0 {
+			return ErrInvalidBody
+		}
+		if sm.MaxFileSize > 0 && file.Size > sm.MaxFileSize {
+			return fmt.Errorf("%w: %s has %d bytes, the limit is %d bytes", ErrTooLarge, file.FileName, file.Size, sm.MaxFileSize)
+		}
+		// declared sizes can add up past the range of the sum, no disk holds that much anyway
+		if uint64(file.Size) > math.MaxUint64-total {
+			return fmt.Errorf("%w: the declared file sizes overflow", ErrTooLarge)
+		}
+		total += uint64(file.Size)
+	}
+	if sm.MaxSessionSize > 0 && total > uint64(sm.MaxSessionSize) {
+		return fmt.Errorf("%w: the session has %d bytes, the limit is %d bytes", ErrTooLarge, total, sm.MaxSessionSize)
+	}
+
+	free, err := freeSpace(existingDir(sm.BasePath))
+	if err != nil {
+		// not being able to tell is no reason to refuse, writing will fail if the disk really is full
+		slog.Debug("could not determine free space", slog.String("dir", sm.BasePath), slog.Any("error", err))
+		return nil
+	}
+	// running sessions will still need the space for their missing files
+	reserved := sm.reservedSpace()
+	if total > free || reserved > free-total {
+		return fmt.Errorf("%w: the session needs %d bytes, only %d bytes are free", ErrInsufficientStorage, total, free-min(free, reserved))
+	}
+	return nil
+}
+
+// the declared size of all files of running downloads that are not done yet. Has to be called with dlLock held
+func (sm *SessionManager) reservedSpace() uint64 {
+	var reserved uint64
+	for _, sess := range sm.Downloads {
+		sess.lock.Lock()
+		for _, file := range sess.Files {
+			if !file.Done {
+				reserved += uint64(file.Size)
+			}
+		}
+		sess.lock.Unlock()
+	}
+	return reserved
+}
+
+// the download folder is created with the first file, until then the free space of its closest existing parent is used
+func existingDir(dir string) string {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,188 @@
+package sessions
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// files are written under a temporary name until they are complete, so interrupted uploads can be resumed
+// and nothing watching the download folder picks up incomplete files
+const partialSuffix = ".gclsnd-partial"
+
+// names windows reserves for devices, with or without an extension
+var deviceNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Clean a file name supplied by a peer. Peers send slash separated paths relative to the download folder.
+// Traversal, absolute paths and control characters are rejected, names that are invalid on windows or look like
+// partial files are neutralised.
+// The returned name uses forward slashes
+func sanitizeFileName(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty file name")
+	}
+	for _, r := range name {
+		// format characters like the right-to-left override can disguise the extension of a file
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", errors.New("control character in file name")
+		}
+	}
+	// windows clients might use backslashes as separators
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") {
+		return "", errors.New("absolute file name")
+	}
+	parts := make([]string, 0, strings.Count(name, "/")+1)
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.New("file name leaves the download folder")
+		}
+		// windows silently drops trailing dots and spaces, which would turn "..." into ".."
+		part = strings.TrimRight(part, ". ")
+		if part == "" {
+			continue
+		}
+		part = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`<>:"|?*`, r) {
+				return '_'
+			}
+			return r
+		}, part)
+		base, _, _ := strings.Cut(part, ".")
+		if deviceNames[strings.ToUpper(strings.TrimSpace(base))] {
+			part = "_" + part
+		}
+		// received files must not look like partial files, those are deleted on start and clash with the temporary name of other files
+		if len(part) >= len(partialSuffix) && strings.EqualFold(part[len(part)-len(partialSuffix):], partialSuffix) {
+			part += "_"
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", errors.New("file name has no usable parts")
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// Check that a path stays inside the download folder. Directories can change between accepting a session and
+// receiving its files, so writes should check again right before opening the file
+func (sm *SessionManager) Confine(path string) error {
+	return confine(sm.BasePath, path)
+}
+
+// Check that the path stays inside the root directory after resolving symlinks
+func confine(root string, path string) error {
+	resolvedRoot, err := resolveExisting(root)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveExisting(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil {
+		return err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return errors.New("path leaves the download folder")
+	}
+	return nil
+}
+
+// Resolve the symlinks of a path that might not exist yet.
+// Parts of the path that do not exist can not be symlinks, so only the longest existing prefix is resolved.
+// Symlinks whose target does not exist are resolved to that target
+func resolveExisting(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	existing := path
+	rest := ""
+	links := 0
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		// a dangling symlink still decides where a write through it ends up, so it is followed to its target
+		if info, lerr := os.Lstat(existing); lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+			links++
+			if links > 255 {
+				return "", errors.New("too many levels of symbolic links")
+			}
+			dest, err := os.Readlink(existing)
+			if err != nil {
+				return "", err
+			}
+			if !filepath.IsAbs(dest) {
+				dir, err := filepath.EvalSymlinks(filepath.Dir(existing))
+				if err != nil {
+					return "", err
+				}
+				dest = filepath.Join(dir, dest)
+			}
+			existing = dest
+			continue
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return path, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// The temporary name of a file while it is being received
+func PartialPath(target string) string {
+	return target + partialSuffix
+}
+
+// Remove the partial files of incomplete transfers from the download folder.
+// Sessions do not survive restarts, so leftover partial files can never be completed
+func (sm *SessionManager) RemovePartials() {
+	err := filepath.WalkDir(sm.BasePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.Type().IsRegular() && strings.HasSuffix(path, partialSuffix) {
+			slog.Info("removing incomplete file", slog.String("file", path))
+			if err := os.Remove(path); err != nil {
+				slog.Error("failed to remove incomplete file", slog.String("file", path), slog.Any("error", err))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("failed to clean up incomplete files", slog.String("dir", sm.BasePath), slog.Any("error", err))
+	}
+}
+
+// remove the partial files of a download session that are not done yet. Has to be called with the session lock held
+func (sess *Session) removePartials() {
+	for _, file := range sess.Files {
+		if file.Done || file.Destination == "" {
+			continue
+		}
+		err := os.Remove(PartialPath(file.Destination))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("failed to remove incomplete file", slog.String("file", file.FileName), slog.Any("error", err))
+		}
+	}
+}
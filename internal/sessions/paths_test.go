@@ -0,0 +1,157 @@
+package sessions
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", in: "photo.jpg", want: "photo.jpg"},
+		{name: "nested", in: "photos/2024/photo.jpg", want: "photos/2024/photo.jpg"},
+		{name: "empty", in: "", wantErr: true},
+		{name: "empty parts", in: "a//./b", want: "a/b"},
+		{name: "parent", in: "../photo.jpg", wantErr: true},
+		{name: "parent in the middle", in: "a/../../photo.jpg", wantErr: true},
+		{name: "backslash parent", in: `..\..\photo.jpg`, wantErr: true},
+		{name: "backslash separators", in: `photos\photo.jpg`, want: "photos/photo.jpg"},
+		{name: "absolute", in: "/etc/passwd", wantErr: true},
+		{name: "absolute with backslash", in: `\etc\passwd`, wantErr: true},
+		{name: "drive letter", in: `C:\Windows\system.ini`, want: "C_/Windows/system.ini"},
+		{name: "device name", in: "CON", want: "_CON"},
+		{name: "device name with extension", in: "nul.txt", want: "_nul.txt"},
+		{name: "device name in a directory", in: "a/lpt1/b", want: "a/_lpt1/b"},
+		{name: "not a device name", in: "console.txt", want: "console.txt"},
+		{name: "trailing dots", in: "photo.jpg...", want: "photo.jpg"},
+		{name: "trailing spaces", in: "photo.jpg  ", want: "photo.jpg"},
+		{name: "dots only", in: "...", wantErr: true},
+		{name: "dots that would become a parent", in: "a/.../b", want: "a/b"},
+		{name: "reserved characters", in: `a<b>c:d"e|f?g*h`, want: "a_b_c_d_e_f_g_h"},
+		{name: "null byte", in: "photo\x00.jpg", wantErr: true},
+		{name: "newline", in: "photo\n.jpg", wantErr: true},
+		{name: "escape sequence", in: "\x1b[31mphoto.jpg", wantErr: true},
+		{name: "right-to-left override", in: "photo\u202egpj.exe", wantErr: true},
+		{name: "zero width space", in: "photo\u200b.jpg", wantErr: true},
+		{name: "unicode", in: "fotos/größe €.jpg", want: "fotos/größe €.jpg"},
+		{name: "partial suffix", in: "photo.jpg" + partialSuffix, want: "photo.jpg" + partialSuffix + "_"},
+		{name: "partial suffix in other case", in: "photo.GCLSND-PARTIAL", want: "photo.GCLSND-PARTIAL_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeFileName(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("sanitizeFileName(%q) = %q, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeFileName(%q) failed: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Fatalf("sanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfine(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "downloads")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "photos"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "photos"), filepath.Join(root, "pictures")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "file in root", path: filepath.Join(root, "photo.jpg")},
+		{name: "file in existing directory", path: filepath.Join(root, "photos", "photo.jpg")},
+		{name: "file in missing directories", path: filepath.Join(root, "a", "b", "photo.jpg")},
+		{name: "root itself", path: root},
+		{name: "parent", path: filepath.Join(root, "..", "photo.jpg"), wantErr: true},
+		{name: "sibling with the same prefix", path: root + "-other" + string(filepath.Separator) + "photo.jpg", wantErr: true},
+		{name: "absolute outside", path: filepath.Join(outside, "photo.jpg"), wantErr: true},
+		{name: "symlink to outside", path: filepath.Join(root, "escape", "photo.jpg"), wantErr: true},
+		{name: "symlink to outside with missing directories", path: filepath.Join(root, "escape", "a", "photo.jpg"), wantErr: true},
+		{name: "dangling symlink to outside", path: filepath.Join(root, "dangling"), wantErr: true},
+		{name: "symlink inside", path: filepath.Join(root, "pictures", "photo.jpg")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := confine(root, tt.path)
+			if tt.wantErr && err == nil {
+				t.Fatalf("confine(%q) succeeded, want an error", tt.path)
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("confine(%q) failed: %v", tt.path, err)
+			}
+		})
+	}
+}
+
+func TestResolveExisting(t *testing.T) {
+	base := t.TempDir()
+	// the temporary directory itself can be behind a symlink, e.g. /tmp on macos
+	base, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(base, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	dangling := filepath.Join(base, "dangling")
+	if err := os.Symlink(filepath.Join("target", "missing"), dangling); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "existing", path: target, want: target},
+		{name: "missing", path: filepath.Join(base, "a", "b"), want: filepath.Join(base, "a", "b")},
+		{name: "symlink", path: link, want: target},
+		{name: "missing below symlink", path: filepath.Join(link, "a", "b"), want: filepath.Join(target, "a", "b")},
+		{name: "dangling symlink", path: dangling, want: filepath.Join(target, "missing")},
+		{name: "missing below dangling symlink", path: filepath.Join(dangling, "a"), want: filepath.Join(target, "missing", "a")},
+		{name: "unclean", path: filepath.Join(base, "a") + "/../link/./b", want: filepath.Join(target, "b")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveExisting(tt.path)
+			if err != nil {
+				t.Fatalf("resolveExisting(%q) failed: %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Fatalf("resolveExisting(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// the peer has to wait until running sessions are finished
+	ErrBlocked = errors.New("Blocked by another session")
+	// too many sessions are waiting for the user to accept them
+	ErrTooManyOffers = errors.New("Too many pending offers")
+)
+
+// How many incoming sessions are allowed at the same time
+type ReceivePolicy string
+
+const (
+	// one session at a time, like the reference implementation
+	PolicySingle ReceivePolicy = "single"
+	// up to MaxSessions sessions at a time, 0 means no limit
+	PolicyConcurrent ReceivePolicy = "concurrent"
+	// one session per peer, different peers can send at the same time
+	PolicyPerPeer ReceivePolicy = "peer"
+)
+
+// Parse the receive policy of the config. Unknown names are an error, a typo would otherwise behave like single
+func ParseReceivePolicy(name string) (ReceivePolicy, error) {
+	policy := ReceivePolicy(name)
+	switch policy {
+	case PolicySingle, PolicyConcurrent, PolicyPerPeer:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown receive policy %q, use single, concurrent or peer", name)
+}
+
+// Check if a new incoming session is allowed next to the running and offered ones.
+// Has to be called with dlLock held
+func (sm *SessionManager) admit(candidate *Session) error {
+	// every offer ties up a request until the user answers it
+	if sm.MaxOffers > 0 && len(sm.offers) >= sm.MaxOffers {
+		return ErrTooManyOffers
+	}
+	active := sm.activeDownloads()
+	switch sm.Policy {
+	case PolicyConcurrent:
+		if sm.MaxSessions > 0 && len(active) >= sm.MaxSessions {
+			return ErrBlocked
+		}
+	case PolicyPerPeer:
+		for _, sess := range active {
+			if sess.Origin.IP.Equal(candidate.Origin.IP) {
+				return ErrBlocked
+			}
+		}
+	default:
+		if len(active) != 0 {
+			return ErrBlocked
+		}
+	}
+	return nil
+}
+
+// Running downloads and offers that wait for an answer. Has to be called with dlLock held
+func (sm *SessionManager) activeDownloads() []*Session {
+	active := make([]*Session, 0, len(sm.Downloads)+len(sm.offers))
+	for _, sess := range sm.Downloads {
+		active = append(active, sess)
+	}
+	for id, sess := range sm.offers {
+		// accepted offers are briefly in both sets
+		if _, ok := sm.Downloads[id]; !ok {
+			active = append(active, sess)
+		}
+	}
+	return active
+}
+
+// Returns true if an incoming session is running or waiting to be accepted
+func (sm *SessionManager) Busy() bool {
+	sm.dlLock.Lock()
+	defer sm.dlLock.Unlock()
+	return len(sm.activeDownloads()) != 0
+}
@@ -0,0 +1,95 @@
+package sessions
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/atomic-7/gocalsend/internal/data"
+)
+
+// how often a running transfer reports its progress to the ui
+const progressInterval = 250 * time.Millisecond
+
+// Snapshot of a running file transfer
+type Progress struct {
+	SessionID string
+	FileID    string
+	FileName  string
+	// bytes of the file that arrived at the receiver, including the part of a resumed upload that was sent earlier
+	Done  int64
+	Total int64
+	// bytes per second since the transfer started
+	Rate float64
+}
+
+// Counts the bytes read from the wrapped reader and reports them to the ui, at most once per progressInterval
+type progressReader struct {
+	r        io.Reader
+	ui       UIHooks
+	progress Progress
+	offset   int64
+	start    time.Time
+	last     time.Time
+	// the final report is only sent once, the read that completes the file can be followed by EOF
+	finished bool
+}
+
+// Wrap the body of a file transfer so its progress shows up in the ui. offset is the amount of the file that was transferred before
+func (sm *SessionManager) TrackProgress(sessID string, file *data.File, offset int64, r io.Reader) io.Reader {
+	now := time.Now()
+	return &progressReader{
+		r:  r,
+		ui: sm.ui,
+		progress: Progress{
+			SessionID: sessID,
+			FileID:    file.ID,
+			FileName:  file.FileName,
+			Done:      offset,
+			Total:     file.Size,
+		},
+		offset: offset,
+		start:  now,
+		last:   now,
+	}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.progress.Done += int64(n)
+	now := time.Now()
+	final := err == io.EOF || pr.progress.Done == pr.progress.Total
+	if pr.finished || (!final && now.Sub(pr.last) < progressInterval) {
+		return n, err
+	}
+	// the last read is always reported so the ui does not stop short of the end
+	pr.finished = final
+	pr.last = now
+	if elapsed := now.Sub(pr.start).Seconds(); elapsed > 0 {
+		pr.progress.Rate = float64(pr.progress.Done-pr.offset) / elapsed
+	}
+	pr.ui.FileProgress(pr.progress)
+	return n, err
+}
+
+// Share of the file that was transferred, between 0 and 1
+func (p Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return 1
+	}
+	return float64(p.Done) / float64(p.Total)
+}
+
+// Human readable size with binary units, e.g. 1.5 MiB
+func FormatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
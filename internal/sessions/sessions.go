@@ -2,48 +2,163 @@ package sessions
 
 import (
 	"context"
-	"crypto/sha256"
+	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/atomic-7/gocalsend/internal/data"
 )
 
+var (
+	// the user declined the session or did not answer in time
+	ErrRejected = errors.New("Rejected")
+	// the session was accepted but no files need to be transferred, e.g. text messages
+	ErrFinished = errors.New("Finished")
+	// the session offer contains missing or unsafe data, e.g. file names that leave the download folder
+	ErrInvalidBody = errors.New("Invalid body")
+)
+
 type SessionManager struct {
 	BasePath string
-	Serial   int
+	// how to handle received files whose name is already taken
+	Conflicts ConflictPolicy
+	// sessions with larger files or a larger total size are refused, 0 means no limit
+	MaxFileSize    int64
+	MaxSessionSize int64
+	// received files get the modification and access time of the original file
+	KeepFileTimes bool
+	// how many incoming sessions can be offered or running at the same time
+	Policy      ReceivePolicy
+	MaxSessions int
+	// how many incoming sessions can wait for an answer of the user, 0 means no limit
+	MaxOffers int
+	// download sessions that receive no data for this long are cancelled, so a peer that vanished
+	// does not block other peers forever. 0 disables the timeout
+	IdleTimeout time.Duration
+	// incoming sessions that wait for the user to accept them
+	offers map[string]*Session
 	// Downloads and uploads can probably be combined, but keeping them seperate for now
 	// this makes rendering uploads and downloads seperately easier in the ui
 	Downloads map[string]*Session
 	Uploads   map[string]*Session
+	// Shares are sessions of peers downloading files the local node offers via the download api
+	Shares    map[string]*Session
+	shared    map[string]*data.File
 	ui        UIHooks
 	dlLock    sync.Mutex
 	upLock    sync.Mutex
+	shareLock sync.Mutex
 	ctxGlobal context.Context
 }
 
-// maybe track which peer this session belongs to. Needed to check for 403
+// where a session request came from, later requests of the session have to come from the same place
+type Origin struct {
+	IP net.IP
+	// sha256 of the tls client certificate, empty for http or peers that do not send a certificate
+	Fingerprint string
+}
+
+// Requests match the origin of a session if they come from the same ip and, if the session was created
+// with a client certificate, present the same certificate
+func (o Origin) Matches(other Origin) bool {
+	if !o.IP.Equal(other.IP) {
+		return false
+	}
+	return o.Fingerprint == "" || o.Fingerprint == other.Fingerprint
+}
+
 type Session struct {
 	SessionID string
 	Files     map[string]*data.File //map between file ids and file structs
 	Remaining int
 	Peer      *data.PeerInfo
-	lock      sync.Mutex
-	ctx       context.Context
-	cancel    context.CancelFunc
+	// the peer that created a download session
+	Origin Origin
+	// ids of offered files whose name is already taken in the download folder
+	Conflicts []string
+	// set by the ui when accepting a session with conflicts and the conflict policy is ask
+	Resolution ConflictPolicy
+	// ids of files that failed, they count as finished unless a retry of the peer succeeds
+	failed map[string]bool
+	// ids of files a request is currently writing, a retry must not append to the same partial file at the same time
+	writing map[string]bool
+	// cancels the session after idleTimeout without any data, nil if the session has no timeout
+	idle        *time.Timer
+	idleTimeout time.Duration
+	lock        sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
+
+// The context of the session is done once the session is cancelled or finished
 func (s *Session) GetCtx() context.Context {
-	return s.ctx	
+	return s.ctx
+}
+
+// Claim a file for writing. Returns false if another request is already writing it
+func (s *Session) StartWriting(fileID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.writing[fileID] {
+		return false
+	}
+	if s.writing == nil {
+		s.writing = make(map[string]bool)
+	}
+	s.writing[fileID] = true
+	return true
+}
+
+// Release a file claimed with StartWriting
+func (s *Session) StopWriting(fileID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.writing, fileID)
+}
+
+// Restart the idle timeout of the session, transfers call this whenever data arrives
+func (s *Session) Touch() {
+	if s.idle != nil {
+		s.idle.Reset(s.idleTimeout)
+	}
+}
+
+// A session is a text message if it consists of a single text file that has a preview.
+// The preview already contains the whole message, so nothing needs to be written to disk
+func (s *Session) IsMessage() bool {
+	if len(s.Files) != 1 {
+		return false
+	}
+	for _, file := range s.Files {
+		return strings.HasPrefix(file.FileType, "text/plain") && file.Preview != ""
+	}
+	return false
+}
+
+// returns the text of a message session
+func (s *Session) Message() string {
+	for _, file := range s.Files {
+		return file.Preview
+	}
+	return ""
 }
 
 type UIHooks interface {
 	// can block until user accpets or times out
 	OfferSession(*Session, chan bool)
 	FileFinished()
+	FileFailed(*Session, *data.File, error)
+	// called periodically while a file is transferred, must not block
+	FileProgress(Progress)
 	SessionCreated()
 	SessionFinished()
 	SessionCancelled()
@@ -51,49 +166,104 @@ type UIHooks interface {
 
 func NewSessionManager(ctx context.Context, basePath string, uihooks UIHooks) *SessionManager {
 	return &SessionManager{
-		BasePath:  basePath,
-		Serial:    1,
-		Downloads: make(map[string]*Session),
-		Uploads:   make(map[string]*Session),
-		ui:        uihooks,
-		ctxGlobal: ctx,
+		BasePath:    basePath,
+		Conflicts:   ConflictRename,
+		Policy:      PolicySingle,
+		MaxOffers:   5,
+		IdleTimeout: 2 * time.Minute,
+		offers:      make(map[string]*Session),
+		Downloads:   make(map[string]*Session),
+		Uploads:     make(map[string]*Session),
+		Shares:      make(map[string]*Session),
+		ui:          uihooks,
+		ctxGlobal:   ctx,
+	}
+}
+
+// Returns n random bytes from crypto/rand encoded as hex. Session ids and tokens must not be guessable,
+// otherwise anyone on the network could inject files into running sessions
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
 	}
+	return hex.EncodeToString(buf)
 }
 
-func (sm *SessionManager) tokenize(sess *data.SessionInfo, file *data.File) string {
-	token := fmt.Sprintf("%s.%s", sess.SessionID, file.ID)
-	return hex.EncodeToString(sha256.New().Sum([]byte(token)))
+// Compare a token supplied by a peer in constant time to not leak how much of it is correct
+func ValidToken(expected string, actual string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
 }
 
-// asks the ui to accept the session and creates if it if the user accepts. returns nil if the session offer is rejected
-func (sm *SessionManager) CreateSession(peer *data.PeerInfo, files map[string]*data.File) *data.SessionInfo {
+// asks the ui to accept the session and creates if it if the user accepts.
+// returns ErrRejected if the session offer is rejected and ErrFinished if the session needs no file transfers
+func (sm *SessionManager) CreateSession(peer *data.PeerInfo, origin Origin, files map[string]*data.File) (*data.SessionInfo, error) {
 	fileToToken := make(map[string]string, len(files))
 	idToFile := make(map[string]*data.File, len(files))
-	sm.Serial += 1
-	sessID := fmt.Sprintf("gclsnd-%d", sm.Serial)
+	sessID := randomHex(16)
 	sessInfo := &data.SessionInfo{
 		SessionID: sessID,
 		Files:     fileToToken,
 	}
-	// TODO: Check if there are already existing files with the same name in the BasePath
 	for fileID, file := range files {
+		if file == nil {
+			return nil, ErrInvalidBody
+		}
+		fileName, err := sanitizeFileName(file.FileName)
+		if err != nil {
+			slog.Info("rejecting session with invalid file name", slog.String("file", file.FileName), slog.Any("error", err))
+			return nil, ErrInvalidBody
+		}
+		file.FileName = fileName
+		file.Destination = filepath.Join(sm.BasePath, filepath.FromSlash(fileName))
+		if err = confine(sm.BasePath, file.Destination); err != nil {
+			slog.Info("rejecting session with file outside of the download folder", slog.String("file", fileName), slog.Any("error", err))
+			return nil, ErrInvalidBody
+		}
 		files[fileID].ID = fileID
-		token := sm.tokenize(sessInfo, file)
+		token := randomHex(32)
 		files[fileID].Token = token
 		fileToToken[fileID] = token
 		idToFile[fileID] = file
 	}
+	sm.dlLock.Lock()
+	err := sm.checkLimits(idToFile)
+	sm.dlLock.Unlock()
+	if err != nil {
+		slog.Info("refusing session", slog.String("sessionId", sessID), slog.Any("reason", err))
+		return nil, err
+	}
 	ctxChild, cancel := context.WithCancel(sm.ctxGlobal)
 	sessionCandidate := &Session{
 		SessionID: sessID,
 		Files:     idToFile,
 		Remaining: len(idToFile),
 		Peer:      peer,
+		Origin:    origin,
 		ctx:       ctxChild,
 		cancel:    cancel,
 	}
+	sm.dlLock.Lock()
+	if err := sm.admit(sessionCandidate); err != nil {
+		sm.dlLock.Unlock()
+		cancel()
+		slog.Info("blocking session", slog.String("sessionId", sessID), slog.Any("reason", err))
+		return nil, err
+	}
+	sm.offers[sessID] = sessionCandidate
+	if !sessionCandidate.IsMessage() {
+		sessionCandidate.Conflicts = sm.findConflicts(idToFile)
+	}
+	sm.dlLock.Unlock()
+	// the offer stops counting against the receive policy once it is answered, accepted sessions count as downloads
+	defer func() {
+		sm.dlLock.Lock()
+		delete(sm.offers, sessID)
+		sm.dlLock.Unlock()
+	}()
 
-	res := make(chan bool)
+	// buffered so the ui does not block when answering an offer that already timed out
+	res := make(chan bool, 1)
 	// TODO: make offer sessions take a timeout context
 	sm.ui.OfferSession(sessionCandidate, res)
 	timer := time.NewTimer(1 * time.Minute)
@@ -103,29 +273,72 @@ func (sm *SessionManager) CreateSession(peer *data.PeerInfo, files map[string]*d
 		slog.Debug("Session offer timed out", slog.Any("sess", sessInfo))
 	case answer = <-res:
 		slog.Debug("User accepted session")
+	case <-ctxChild.Done():
+		slog.Debug("Session offer cancelled", slog.String("sessionId", sessID))
 	}
-	if answer {
-		sm.dlLock.Lock()
-		sm.Downloads[sessInfo.SessionID] = sessionCandidate
+	if !answer {
+		cancel()
+		return nil, ErrRejected
+	}
+	if sessionCandidate.IsMessage() {
+		// the ui displayed the message with the offer
+		cancel()
+		slog.Info("received message", slog.String("sessionId", sessID))
+		return nil, ErrFinished
+	}
+	policy := sm.Conflicts
+	if policy == ConflictAsk {
+		policy = sessionCandidate.Resolution
+	}
+	sm.dlLock.Lock()
+	sm.resolveConflicts(sessionCandidate, sessInfo, policy)
+	if len(sessionCandidate.Files) == 0 {
 		sm.dlLock.Unlock()
-		sm.ui.SessionCreated()
-		return sessInfo
-	} else {
-		return nil
+		cancel()
+		slog.Info("all files of the session already exist", slog.String("sessionId", sessID))
+		return nil, ErrFinished
+	}
+	sm.startIdleTimer(sessionCandidate)
+	sm.Downloads[sessInfo.SessionID] = sessionCandidate
+	sm.dlLock.Unlock()
+	sm.ui.SessionCreated()
+	return sessInfo, nil
+}
+
+// the timer is stopped when the session ends, until then every Touch pushes it back
+func (sm *SessionManager) startIdleTimer(sess *Session) {
+	if sm.IdleTimeout <= 0 {
+		return
 	}
+	sess.idleTimeout = sm.IdleTimeout
+	sess.idle = time.AfterFunc(sm.IdleTimeout, func() {
+		if sess.ctx.Err() != nil {
+			return
+		}
+		slog.Info("cancelling idle session", slog.String("sessionId", sess.SessionID), slog.Duration("timeout", sm.IdleTimeout))
+		sm.CancelSession(sess.SessionID)
+	})
+	context.AfterFunc(sess.ctx, func() {
+		sess.idle.Stop()
+	})
 }
 
 func (sm *SessionManager) CreateUpload(peer *data.PeerInfo, sess *data.SessionInfo, files map[string]*data.File) string {
-	// sm.Serial += 1
+	// the peer only returns tokens for the files it wants, e.g. it might skip files it already has
+	accepted := make(map[string]*data.File, len(sess.Files))
 	for fileID, file := range files {
-		file.Token = sess.Files[fileID]
+		token, ok := sess.Files[fileID]
+		if !ok {
+			slog.Info("peer skipped file", slog.String("file", file.FileName))
+			continue
+		}
+		file.Token = token
+		accepted[fileID] = file
 	}
+	files = accepted
 	sm.upLock.Lock()
 	ctxChild, cancel := context.WithCancel(sm.ctxGlobal)
-	// sessID := fmt.Sprintf("gclsnd-client-%d", sm.Serial)
-	// using the session id from the peer could lead to collisions or security risks
-	// this might get acceptable when combined with a check which peer a session belongs to
-	// this is not implemented yet, also makes serial a bit useless
+	// uploads are keyed by the session id the peer handed out, peers generate random ids so collisions are unlikely
 	sm.Uploads[sess.SessionID] = &Session{
 		SessionID: sess.SessionID,
 		Files:     files,
@@ -139,61 +352,213 @@ func (sm *SessionManager) CreateUpload(peer *data.PeerInfo, sess *data.SessionIn
 	return sess.SessionID
 }
 
+// Find the download session containing a file with the given id and token. Needed for protocol v1 which has no session ids.
+// Returns nil if no session matches
+func (sm *SessionManager) FindDownload(fileID string, token string) *Session {
+	sm.dlLock.Lock()
+	defer sm.dlLock.Unlock()
+	for _, sess := range sm.Downloads {
+		if file, ok := sess.Files[fileID]; ok && ValidToken(file.Token, token) {
+			return sess
+		}
+	}
+	return nil
+}
+
+// Cancel all download sessions of the peer with the given ip. Returns the number of cancelled sessions
+func (sm *SessionManager) CancelPeerSessions(ip net.IP) int {
+	sm.dlLock.Lock()
+	ids := make([]string, 0, 1)
+	for id, sess := range sm.Downloads {
+		if sess.Origin.IP.Equal(ip) {
+			ids = append(ids, id)
+		}
+	}
+	sm.dlLock.Unlock()
+	for _, id := range ids {
+		sm.CancelSession(id)
+	}
+	return len(ids)
+}
+
+// Offer files for peers to download. Passing nil stops sharing, already running share sessions are not affected
+func (sm *SessionManager) ShareFiles(files map[string]*data.File) {
+	sm.shareLock.Lock()
+	sm.shared = files
+	sm.shareLock.Unlock()
+}
+
+// returns true if the local node currently offers files for download
+func (sm *SessionManager) IsSharing() bool {
+	sm.shareLock.Lock()
+	defer sm.shareLock.Unlock()
+	return len(sm.shared) != 0
+}
+
+// Get the share session with the given id if it belongs to the origin. Otherwise the share session of the origin is reused,
+// or a new one is created for the currently shared files. Returns nil if no files are shared
+func (sm *SessionManager) GetShare(peer *data.PeerInfo, origin Origin, sessID string) *Session {
+	sm.shareLock.Lock()
+	defer sm.shareLock.Unlock()
+	// a known session id alone does not grant access to a session of another host
+	if sess, ok := sm.Shares[sessID]; ok && sess.Origin.Matches(origin) {
+		return sess
+	}
+	if len(sm.shared) == 0 {
+		return nil
+	}
+	// every reload of the web share asks for a session, one per peer keeps the set from growing
+	for _, sess := range sm.Shares {
+		if sess.Origin.Matches(origin) {
+			return sess
+		}
+	}
+	sessID = randomHex(16)
+	// every share session gets its own copy of the files so the done state is tracked per session
+	files := make(map[string]*data.File, len(sm.shared))
+	for fileID, file := range sm.shared {
+		fileCopy := *file
+		fileCopy.Done = false
+		files[fileID] = &fileCopy
+	}
+	ctxChild, cancel := context.WithCancel(sm.ctxGlobal)
+	sess := &Session{
+		SessionID: sessID,
+		Files:     files,
+		Remaining: len(files),
+		Peer:      peer,
+		Origin:    origin,
+		ctx:       ctxChild,
+		cancel:    cancel,
+	}
+	sm.Shares[sessID] = sess
+	sm.ui.SessionCreated()
+	return sess
+}
+
+// Get a running download session, uploads from peers can access it concurrently
+func (sm *SessionManager) Download(sessID string) (*Session, bool) {
+	sm.dlLock.Lock()
+	defer sm.dlLock.Unlock()
+	sess, ok := sm.Downloads[sessID]
+	return sess, ok
+}
+
+// Get a running upload session
+func (sm *SessionManager) Upload(sessID string) (*Session, bool) {
+	sm.upLock.Lock()
+	defer sm.upLock.Unlock()
+	sess, ok := sm.Uploads[sessID]
+	return sess, ok
+}
+
+// Get a running share session without creating a new one
+func (sm *SessionManager) Share(sessID string) (*Session, bool) {
+	sm.shareLock.Lock()
+	defer sm.shareLock.Unlock()
+	sess, ok := sm.Shares[sessID]
+	return sess, ok
+}
+
 func (sm *SessionManager) CancelSession(sessionID string) {
-	// TODO: test cancel route with invalid sessionID
-	// TODO: Delete associated files if a session is cancelled before it is completed?
-	if sess, ok := sm.Downloads[sessionID]; ok {
-		sess.cancel()
-		sess.cancel = nil
-		sess.ctx = nil
-		// TODO: Provide info to display about cancelled session
-		sm.dlLock.Lock()
-		delete(sm.Downloads, sessionID)
-		sm.dlLock.Unlock()
-		sm.ui.SessionCancelled()
-		slog.Debug("removed download", slog.String("id", sessionID))
+	sess, set, lock := sm.lookup(sessionID)
+	if sess == nil {
+		slog.Debug("cancel for unknown session", slog.String("id", sessionID))
 		return
 	}
-	if sess, ok := sm.Uploads[sessionID]; ok {
-		sess.cancel()
-		sess.cancel = nil
-		sess.ctx = nil
-		sm.upLock.Lock()
-		delete(sm.Uploads, sessionID)
-		sm.upLock.Unlock()
-		sm.ui.SessionCancelled()
-		slog.Debug("removed upload", slog.String("id", sessionID))
+	// the context stays with the session, transfers still holding a reference see that it is done
+	sess.cancel()
+	lock.Lock()
+	delete(set, sessionID)
+	lock.Unlock()
+	if lock == &sm.dlLock {
+		// completed files are kept, incomplete ones can not be resumed without the session
+		sess.lock.Lock()
+		sess.removePartials()
+		sess.lock.Unlock()
 	}
+	// TODO: Provide info to display about cancelled session
+	sm.ui.SessionCancelled()
+	slog.Debug("removed session", slog.String("id", sessionID))
 }
 
-// Finish processing a file. References to sessions can become invalid after calling this if the entire session is finished as well
-func (sm *SessionManager) FinishFile(sessID string, fileID string) error {
-	set := &sm.Downloads
+// Reject all offers that are still waiting for an answer
+func (sm *SessionManager) CancelOffers() {
+	sm.dlLock.Lock()
+	defer sm.dlLock.Unlock()
+	for _, sess := range sm.offers {
+		sess.cancel()
+	}
+}
 
+// Cancel offers, downloads and shares, the sessions peers drive through the server api.
+// Outgoing uploads are left alone, they belong to the uploader
+func (sm *SessionManager) CancelIncoming() {
+	sm.CancelOffers()
+	ids := make([]string, 0)
 	sm.dlLock.Lock()
-	sm.upLock.Lock()
-	if _, isDL := sm.Downloads[sessID]; !isDL {
-		if _, isUP := sm.Uploads[sessID]; !isUP {
-			sm.upLock.Unlock()
-			sm.dlLock.Unlock()
-			return errors.New("Invalid session id")
-		}
-		set = &sm.Uploads
+	for id := range sm.Downloads {
+		ids = append(ids, id)
 	}
-	sm.upLock.Unlock()
 	sm.dlLock.Unlock()
+	sm.shareLock.Lock()
+	for id := range sm.Shares {
+		ids = append(ids, id)
+	}
+	sm.shareLock.Unlock()
+	for _, id := range ids {
+		sm.CancelSession(id)
+	}
+}
+
+// returns the session with the given id together with the set it is stored in and the lock guarding that set
+func (sm *SessionManager) lookup(sessID string) (*Session, map[string]*Session, *sync.Mutex) {
+	sets := []struct {
+		set  map[string]*Session
+		lock *sync.Mutex
+	}{
+		{sm.Downloads, &sm.dlLock},
+		{sm.Uploads, &sm.upLock},
+		{sm.Shares, &sm.shareLock},
+	}
+	for _, s := range sets {
+		s.lock.Lock()
+		sess, ok := s.set[sessID]
+		s.lock.Unlock()
+		if ok {
+			return sess, s.set, s.lock
+		}
+	}
+	return nil, nil, nil
+}
+
+// Finish processing a file. References to sessions can become invalid after calling this if the entire session is finished as well
+func (sm *SessionManager) FinishFile(sessID string, fileID string) error {
+	sess, _, _ := sm.lookup(sessID)
+	if sess == nil {
+		return errors.New("Invalid session id")
+	}
 
-	sess := (*set)[sessID]
 	sess.lock.Lock()
-	defer sess.lock.Unlock()
 	if _, ok := sess.Files[fileID]; !ok {
+		sess.lock.Unlock()
 		return errors.New("Invalid file id")
 	}
+	finished := false
 	if !sess.Files[fileID].Done {
 		sess.Files[fileID].Done = true
-		sess.Remaining -= 1
+		if sess.failed[fileID] {
+			// a retry of a failed file, it was already counted when it failed
+			delete(sess.failed, fileID)
+		} else {
+			sess.Remaining -= 1
+			// only the call that finishes the last file sees this, so the session is finished once
+			finished = sess.Remaining <= 0
+		}
 	}
-	if sess.Remaining <= 0 {
+	// FinishSession takes the lock of the session set, which is held while checkLimits takes the session lock
+	sess.lock.Unlock()
+	if finished {
 		sm.FinishSession(sess.SessionID)
 	}
 	// TODO: Provide info about the finished file
@@ -201,40 +566,88 @@ func (sm *SessionManager) FinishFile(sessID string, fileID string) error {
 	return nil
 }
 
-func (sm *SessionManager) FinishSession(sessionID string) {
-	set := &sm.Downloads
+// Mark a file of a share session as done. Unlike FinishFile the session stays, the files can be downloaded again while they are shared
+func (sm *SessionManager) FinishSharedFile(sessID string, fileID string) error {
+	sess, ok := sm.Share(sessID)
+	if !ok {
+		return errors.New("Invalid session id")
+	}
+	sess.lock.Lock()
+	file, ok := sess.Files[fileID]
+	if !ok {
+		sess.lock.Unlock()
+		return errors.New("Invalid file id")
+	}
+	if !file.Done {
+		file.Done = true
+		sess.Remaining -= 1
+	}
+	sess.lock.Unlock()
+	sm.ui.FileFinished()
+	return nil
+}
 
-	sm.dlLock.Lock()
-	sm.upLock.Lock()
-	if _, isDL := sm.Downloads[sessionID]; !isDL {
-		if _, isUP := sm.Uploads[sessionID]; !isUP {
-			for k, v := range sm.Uploads {
-				slog.Debug("upload", slog.String("id", k), slog.String("sess", v.SessionID))
-			}
-			for k, v := range sm.Downloads {
-				slog.Debug("download", slog.String("id", k), slog.String("sess", v.SessionID))
-			}
-			sm.upLock.Unlock()
-			sm.dlLock.Unlock()
-			slog.Error("called finished session with invalid session", slog.String("id", sessionID))
+// Mark a file of a session as failed and report the reason to the ui. Failed files count as finished like in the
+// reference implementation, so the session ends once every file is done or failed. Until then the peer can retry the file
+func (sm *SessionManager) FailFile(sessID string, fileID string, reason error) error {
+	sess, _, _ := sm.lookup(sessID)
+	if sess == nil {
+		return errors.New("Invalid session id")
+	}
+	sess.lock.Lock()
+	file, ok := sess.Files[fileID]
+	if !ok {
+		sess.lock.Unlock()
+		return errors.New("Invalid file id")
+	}
+	finished := false
+	if !file.Done && !sess.failed[fileID] {
+		if sess.failed == nil {
+			sess.failed = make(map[string]bool)
 		}
-		set = &sm.Uploads
+		sess.failed[fileID] = true
+		sess.Remaining -= 1
+		finished = sess.Remaining <= 0
 	}
+	sess.lock.Unlock()
+	slog.Error("file failed", slog.String("sessionId", sessID), slog.String("file", file.FileName), slog.Any("reason", reason))
+	sm.ui.FileFailed(sess, file, reason)
+	if finished {
+		sm.FinishSession(sess.SessionID)
+	}
+	return nil
+}
 
-	sess := (*set)[sessionID]
-	sess.cancel = nil
-	sess.ctx = nil
-	delete(*set, sessionID)
-	sm.upLock.Unlock()
-	sm.dlLock.Unlock()
+func (sm *SessionManager) FinishSession(sessionID string) {
+	sess, set, lock := sm.lookup(sessionID)
+	if sess == nil {
+		slog.Error("called finished session with invalid session", slog.String("id", sessionID))
+		return
+	}
+
+	// releases the context, nothing of the session is running anymore
+	sess.cancel()
+	lock.Lock()
+	delete(set, sessionID)
+	lock.Unlock()
 	sm.ui.SessionFinished()
 	slog.Info("Finished session", slog.String("sessionId", sessionID))
 }
 
 // headless implementation of the ui hook interface
-type HeadlessUI struct{}
+type HeadlessUI struct {
+	// files of parallel uploads report their progress at the same time
+	progressLock sync.Mutex
+}
 
 func (hui *HeadlessUI) OfferSession(sess *Session, res chan bool) {
+	if sess.IsMessage() {
+		alias := "unknown peer"
+		if sess.Peer != nil {
+			alias = sess.Peer.Alias
+		}
+		fmt.Printf("Message from %s:\n%s\n", alias, sess.Message())
+	}
 	go func() {
 		res <- true
 	}()
@@ -244,6 +657,23 @@ func (hui *HeadlessUI) FileFinished() {
 	slog.Debug("file finished", slog.String("src", "headless ui"))
 }
 
+func (hui *HeadlessUI) FileFailed(sess *Session, file *data.File, reason error) {
+	slog.Debug("file failed", slog.String("file", file.FileName), slog.Any("reason", reason), slog.String("src", "headless ui"))
+}
+
+// Print a progress line that is overwritten by the next report. Skipped when stderr is not a terminal, e.g. when it is redirected to a log file
+func (hui *HeadlessUI) FileProgress(p Progress) {
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return
+	}
+	hui.progressLock.Lock()
+	defer hui.progressLock.Unlock()
+	fmt.Fprintf(os.Stderr, "\r\033[K%s %3.0f%% %s/%s %s/s", p.FileName, p.Percent()*100, FormatBytes(float64(p.Done)), FormatBytes(float64(p.Total)), FormatBytes(p.Rate))
+	if p.Done >= p.Total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
 func (hui *HeadlessUI) SessionCreated() {
 	slog.Debug("session created", slog.String("src", "headless ui"))
 }
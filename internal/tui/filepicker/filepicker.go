@@ -16,7 +16,7 @@ import (
 func New() Model {
 	fp := filepicker.New()
 	home, err := os.UserHomeDir()
-	fp.DirAllowed = false // not implemented yet
+	fp.DirAllowed = true
 	fp.AutoHeight = true
 	fp.KeyMap.Open = key.NewBinding(key.WithKeys("l", "right", " "), key.WithHelp("l", "open"))
 	fp.KeyMap.Select = key.NewBinding(key.WithKeys(" "), key.WithHelp("space", "select"))
@@ -142,6 +142,12 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 				Height: m.height - m.fileList.Height(),
 			}
 			m.fp, _ = m.fp.Update(resizeMsg)
+			// the filepicker enters directories when selecting them, step back out to keep picking from the same place
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				var back tea.Cmd
+				m.fp, back = m.fp.Update(tea.KeyMsg{Type: tea.KeyLeft})
+				cmd = tea.Sequence(cmd, back)
+			}
 		}
 	case SELECTEDFILES:
 		m.fileList, cmd = m.fileList.Update(msg)
@@ -1,7 +1,6 @@
 package hooks
 
 import (
-
 	tea "github.com/charmbracelet/bubbletea"
 
 	"github.com/atomic-7/gocalsend/internal/data"
@@ -19,7 +18,21 @@ func NewHooks(p *tea.Program) *UIHooks {
 		program: p,
 	}
 }
+
 type FileFinished bool
+type FileFailed struct {
+	Sess   *sessions.Session
+	File   *data.File
+	Reason error
+}
+
+// an upload could not be started, e.g. because the peer refused the session
+type UploadFailed struct {
+	Reason error
+}
+
+// progress of a running file transfer
+type FileProgress sessions.Progress
 type SessionCreated bool
 type SessionFinished bool
 type SessionCancelled bool
@@ -37,6 +50,14 @@ func (h *UIHooks) FileFinished() {
 	h.program.Send(FileFinished(true))
 }
 
+func (h *UIHooks) FileFailed(sess *sessions.Session, file *data.File, reason error) {
+	h.program.Send(FileFailed{Sess: sess, File: file, Reason: reason})
+}
+
+func (h *UIHooks) FileProgress(progress sessions.Progress) {
+	h.program.Send(FileProgress(progress))
+}
+
 func (h *UIHooks) SessionCreated() {
 	h.program.Send(SessionCreated(true))
 }
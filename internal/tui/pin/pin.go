@@ -0,0 +1,108 @@
+package pin
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/bubbles/help"
+	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Sent when a peer answered a session offer with 401 and a pin has to be entered
+type RequiredMsg struct{}
+
+type Model struct {
+	Done      bool
+	Cancelled bool
+	input     textinput.Model
+	help      help.Model
+	KeyMap    KeyMap
+}
+
+func New() Model {
+	ti := textinput.New()
+	ti.Placeholder = "pin"
+	ti.EchoMode = textinput.EchoPassword
+	ti.CharLimit = 64
+	return Model{
+		Done:      false,
+		Cancelled: false,
+		input:     ti,
+		help:      help.New(),
+		KeyMap:    DefaultKeyMap(),
+	}
+}
+
+// clear the entered pin and focus the input so the model can be reused for the next prompt
+func (m *Model) Reset() tea.Cmd {
+	m.Done = false
+	m.Cancelled = false
+	m.input.Reset()
+	return m.input.Focus()
+}
+
+func (m *Model) Value() string {
+	return strings.TrimSpace(m.input.Value())
+}
+
+func (m Model) Init() tea.Cmd {
+	return nil
+}
+
+func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch {
+		case key.Matches(msg, m.KeyMap.Confirm):
+			m.Done = true
+			m.input.Blur()
+			return m, nil
+		case key.Matches(msg, m.KeyMap.Back):
+			m.Cancelled = true
+			m.input.Blur()
+			return m, nil
+		case key.Matches(msg, m.KeyMap.Quit):
+			return m, tea.Quit
+		}
+	}
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+func (m Model) View() string {
+	var b strings.Builder
+	b.WriteString("The peer requires a pin\n\n")
+	b.WriteString(m.input.View())
+	b.WriteString("\n\n")
+	b.WriteString(m.help.View(m.KeyMap))
+	b.WriteString("\n")
+	return b.String()
+}
+
+func DefaultKeyMap() KeyMap {
+	return KeyMap{
+		Confirm: key.NewBinding(key.WithKeys("enter"), key.WithHelp("enter", "send pin")),
+		Back:    key.NewBinding(key.WithKeys("esc"), key.WithHelp("esc", "abort")),
+		Quit:    key.NewBinding(key.WithKeys("ctrl+c", "ctrl+q"), key.WithHelp("ctrl+c", "quit")),
+	}
+}
+
+type KeyMap struct {
+	Confirm key.Binding
+	Back    key.Binding
+	Quit    key.Binding
+}
+
+// keybindinds to be shown in the mini help view
+func (k KeyMap) ShortHelp() []key.Binding {
+	return []key.Binding{k.Confirm, k.Back, k.Quit}
+}
+
+// keybinds to be shown in the full help view
+func (k KeyMap) FullHelp() [][]key.Binding {
+	return [][]key.Binding{
+		{k.Confirm, k.Back, k.Quit},
+	}
+}
@@ -12,6 +12,7 @@ const (
 	FileSelectScreen = Screen(2)
 	SettingsScreen   = Screen(3)
 	TransfersScreen  = Screen(4)
+	PinScreen        = Screen(5)
 )
 
 func SwitchScreen(screen Screen) tea.Cmd {
@@ -2,6 +2,7 @@ package sessions
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/charmbracelet/bubbles/help"
@@ -43,8 +44,10 @@ func (m *Model) cursorDown() {
 }
 
 
-func (m *Model) acceptSession() {
+func (m *Model) acceptSession(resolution sessions.ConflictPolicy) {
 	if len(m.sessionOffers) != 0 {
+		// the session manager only reads the resolution after receiving the answer
+		m.sessionOffers[m.cursor].Sess.Resolution = resolution
 		m.sessionOffers[m.cursor].Res <- true
 		m.sessionOffers = append(m.sessionOffers[:m.cursor], m.sessionOffers[m.cursor+1:]...)
 	}
@@ -71,6 +74,11 @@ func (m *Model) denyAll() {
 	}
 	m.sessionOffers = make([]*hooks.SessionOffer, 0, 10)
 }
+// the user only decides about existing files if the conflict policy says so
+func (m *Model) askConflicts() bool {
+	return m.SessionManager.Conflicts == sessions.ConflictAsk
+}
+
 func (m *Model) ShouldClose() bool {
 	return len(m.sessionOffers) == 0
 }
@@ -90,7 +98,11 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 		case key.Matches(msg, m.KeyMap.Down):
 			m.cursorDown()
 		case key.Matches(msg, m.KeyMap.Accept):
-			m.acceptSession()
+			m.acceptSession(sessions.ConflictRename)
+		case key.Matches(msg, m.KeyMap.Overwrite) && m.askConflicts():
+			m.acceptSession(sessions.ConflictOverwrite)
+		case key.Matches(msg, m.KeyMap.Skip) && m.askConflicts():
+			m.acceptSession(sessions.ConflictSkip)
 		case key.Matches(msg, m.KeyMap.Deny):
 			m.denySession()
 		case key.Matches(msg, m.KeyMap.DenyAll):
@@ -111,9 +123,25 @@ func (m Model) View() string {
 		if m.cursor == i {
 			indicator = ">"
 		}
+		if offer.Sess.IsMessage() {
+			alias := "unknown peer"
+			if offer.Sess.Peer != nil {
+				alias = offer.Sess.Peer.Alias
+			}
+			fmt.Fprintf(&b, "%s | Message from %s\n", indicator, alias)
+			fmt.Fprintf(&b, "  %s\n", strings.ReplaceAll(offer.Sess.Message(), "\n", "\n  "))
+			continue
+		}
 		fmt.Fprintf(&b, "%s | %s\n", indicator, offer.Sess.SessionID)
-		for _, file := range offer.Sess.Files {
-			fmt.Fprintf(&b, "  # %s - %d \n", file.FileName, file.Size)
+		for fileID, file := range offer.Sess.Files {
+			exists := ""
+			if slices.Contains(offer.Sess.Conflicts, fileID) {
+				exists = "(exists)"
+			}
+			fmt.Fprintf(&b, "  # %s - %d %s\n", file.FileName, file.Size, exists)
+		}
+		if len(offer.Sess.Conflicts) != 0 && m.askConflicts() {
+			b.WriteString("  Existing files are renamed on accept, press o to overwrite or s to skip them\n")
 		}
 	}
 
@@ -130,6 +158,8 @@ func DefaultKeyMap() KeyMap {
 		Down:    key.NewBinding(key.WithKeys("j", "down", "ctrl+n"), key.WithHelp("j", "down")),
 		Accept: key.NewBinding(key.WithKeys("space", "enter","y"), key.WithHelp("enter", "accept")),
 		Deny: key.NewBinding(key.WithKeys("n"), key.WithHelp("n", "deny")),
+		Overwrite: key.NewBinding(key.WithKeys("o"), key.WithHelp("o", "accept and overwrite existing")),
+		Skip: key.NewBinding(key.WithKeys("s"), key.WithHelp("s", "accept and skip existing")),
 		DenyAll: key.NewBinding(key.WithKeys("ctrl+c"), key.WithHelp("ctr+c", "deny all")),
 		Quit:    key.NewBinding(key.WithKeys("q", "ctrl+q"), key.WithHelp("q", "quit")),
 	}
@@ -140,6 +170,8 @@ type KeyMap struct {
 	Down key.Binding
 	Accept key.Binding
 	Deny key.Binding
+	Overwrite key.Binding
+	Skip key.Binding
 	DenyAll key.Binding
 	Quit key.Binding
 }
@@ -151,6 +183,6 @@ func (k KeyMap) ShortHelp() []key.Binding {
 // keybinds to be shown in the full help view
 func (k KeyMap) FullHelp() [][]key.Binding {
 	return [][]key.Binding{
-		{k.Up, k.Down, k.Accept, k.Deny, k.DenyAll, k.Quit},
+		{k.Up, k.Down, k.Accept, k.Overwrite, k.Skip, k.Deny, k.DenyAll, k.Quit},
 	}
 }
@@ -3,30 +3,96 @@ package transfers
 import (
 	"fmt"
 	"log/slog"
+	"sort"
 	"strings"
 
+	"github.com/atomic-7/gocalsend/internal/ratelimit"
 	"github.com/atomic-7/gocalsend/internal/sessions"
 	"github.com/atomic-7/gocalsend/internal/tui/hooks"
 	"github.com/atomic-7/gocalsend/internal/tui/screens"
 	"github.com/charmbracelet/bubbles/help"
 	"github.com/charmbracelet/bubbles/key"
+	"github.com/charmbracelet/bubbles/progress"
 	tea "github.com/charmbracelet/bubbletea"
 )
 
 type Model struct {
 	sman   *sessions.SessionManager
+	errors []string
+	// latest progress report of every running file, by session and file id
+	files  map[string]sessions.Progress
+	bar    progress.Model
 	help   help.Model
 	KeyMap KeyMap
+	// bandwidth limits that can be stepped through while transfers are running
+	SendLimit    *ratelimit.Bandwidth
+	ReceiveLimit *ratelimit.Bandwidth
+}
+
+// total limits in bytes per second to step through, 0 lifts the limit
+var limitSteps = []float64{0, 256 << 10, 1 << 20, 5 << 20, 10 << 20}
+
+// switch the total limit to the next step, the per peer limit stays as configured
+func nextLimit(bw *ratelimit.Bandwidth) {
+	total, perPeer := bw.Limits()
+	next := limitSteps[0]
+	for _, step := range limitSteps {
+		if step > total {
+			next = step
+			break
+		}
+	}
+	bw.SetLimits(next, perPeer)
+	slog.Debug("changed bandwidth limit", slog.Float64("total", next), slog.String("src", "transfers"))
+}
+
+func formatLimit(rate float64) string {
+	if rate <= 0 {
+		return "off"
+	}
+	return sessions.FormatBytes(rate) + "/s"
 }
 
 func New(sman *sessions.SessionManager) Model {
 	return Model{
 		sman:   sman,
+		files:  make(map[string]sessions.Progress),
+		bar:    progress.New(progress.WithDefaultGradient(), progress.WithWidth(40)),
 		help:   help.New(),
 		KeyMap: DefaultKeyMap(),
 	}
 }
 
+func progressKey(sessID string, fileID string) string {
+	return sessID + "/" + fileID
+}
+
+// drop the progress of sessions that are not running anymore
+func (m *Model) pruneProgress() {
+	for k, p := range m.files {
+		_, down := m.sman.Download(p.SessionID)
+		_, up := m.sman.Upload(p.SessionID)
+		if !down && !up {
+			delete(m.files, k)
+		}
+	}
+}
+
+// the progress bars of the files of a session that already started transferring
+func (m Model) sessionProgress(b *strings.Builder, sess *sessions.Session) {
+	ids := make([]string, 0, len(sess.Files))
+	for id := range sess.Files {
+		if _, ok := m.files[progressKey(sess.SessionID, id)]; ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		p := m.files[progressKey(sess.SessionID, id)]
+		fmt.Fprintf(b, "   %s\n   %s %s/s\n", p.FileName, m.bar.ViewAs(p.Percent()), sessions.FormatBytes(p.Rate))
+	}
+}
+
 func (m *Model) cancelAllSessions() tea.Msg {
 	for id, _ := range m.sman.Downloads {
 		m.sman.CancelSession(id)
@@ -48,16 +114,29 @@ func (m Model) Update(msg tea.Msg) (Model, tea.Cmd) {
 			return m, m.cancelAllSessions
 		case key.Matches(msg, m.KeyMap.FileSelect):
 			return m, screens.SwitchScreen(screens.FileSelectScreen)
+		case key.Matches(msg, m.KeyMap.SendLimit):
+			nextLimit(m.SendLimit)
+		case key.Matches(msg, m.KeyMap.ReceiveLimit):
+			nextLimit(m.ReceiveLimit)
 		}
 	case hooks.FileFinished:
 		slog.Debug("received file finished msg", slog.String("src", "transfers"))
+	case hooks.FileFailed:
+		slog.Debug("received file failed msg", slog.String("file", msg.File.FileName), slog.String("src", "transfers"))
+		m.errors = append(m.errors, fmt.Sprintf("%s: %v", msg.File.FileName, msg.Reason))
+	case hooks.FileProgress:
+		m.files[progressKey(msg.SessionID, msg.FileID)] = sessions.Progress(msg)
+	case hooks.UploadFailed:
+		m.errors = append(m.errors, fmt.Sprintf("upload failed: %v", msg.Reason))
 	case hooks.SessionCreated:
 		slog.Debug("received session start msg", slog.String("src", "transfers"))
 	case hooks.SessionFinished:
 		slog.Debug("received session finished msg", slog.String("src", "transfers"))
+		m.pruneProgress()
 	case hooks.SessionCancelled:
 		// TODO: Display that the session got cancelled
 		slog.Debug("received session cancelled msg", slog.String("src", "transfers"))
+		m.pruneProgress()
 		return m, screens.SwitchScreen(screens.FileSelectScreen)
 	}
 	return m, nil
@@ -69,14 +148,26 @@ func (m Model) View() string {
 	if len(m.sman.Downloads) != 0 {
 		b.WriteString("Downloads\n")
 		for _, s := range m.sman.Downloads {
-			fmt.Fprintf(&b, " %s | %s (%d / %d)\n", s.Peer.Alias, s.SessionID, s.Remaining, len(s.Files))
+			fmt.Fprintf(&b, " %s | %s (%d / %d)\n", peerAlias(s), s.SessionID, s.Remaining, len(s.Files))
+			m.sessionProgress(&b, s)
 		}
 		b.WriteString("\n\n")
 	}
 	if len(m.sman.Uploads) != 0 {
 		b.WriteString("Uploads\n")
 		for _, s := range m.sman.Uploads {
-			fmt.Fprintf(&b, " %s | %s (%d / %d)\n", s.Peer.Alias, s.SessionID, s.Remaining, len(s.Files))
+			fmt.Fprintf(&b, " %s | %s (%d / %d)\n", peerAlias(s), s.SessionID, s.Remaining, len(s.Files))
+			m.sessionProgress(&b, s)
+		}
+		b.WriteString("\n\n")
+	}
+	sendTotal, sendPeer := m.SendLimit.Limits()
+	receiveTotal, receivePeer := m.ReceiveLimit.Limits()
+	fmt.Fprintf(&b, "Limits\n send %s (per peer %s)\n receive %s (per peer %s)\n\n", formatLimit(sendTotal), formatLimit(sendPeer), formatLimit(receiveTotal), formatLimit(receivePeer))
+	if len(m.errors) != 0 {
+		b.WriteString("Failed\n")
+		for _, e := range m.errors {
+			fmt.Fprintf(&b, " %s\n", e)
 		}
 		b.WriteString("\n\n")
 	}
@@ -90,24 +181,36 @@ func (m Model) Init() tea.Cmd {
 
 func DefaultKeyMap() KeyMap {
 	return KeyMap{
-		Quit:       key.NewBinding(key.WithKeys("q", "ctrl+c", "ctrl+q"), key.WithHelp("q", "quit")),
-		Cancel:     key.NewBinding(key.WithKeys("c", "esc"), key.WithHelp("esc", "cancel")),
-		FileSelect: key.NewBinding(key.WithKeys("f"), key.WithHelp("f", "pick files to send")),
+		Quit:         key.NewBinding(key.WithKeys("q", "ctrl+c", "ctrl+q"), key.WithHelp("q", "quit")),
+		Cancel:       key.NewBinding(key.WithKeys("c", "esc"), key.WithHelp("esc", "cancel")),
+		FileSelect:   key.NewBinding(key.WithKeys("f"), key.WithHelp("f", "pick files to send")),
+		SendLimit:    key.NewBinding(key.WithKeys("s"), key.WithHelp("s", "send limit")),
+		ReceiveLimit: key.NewBinding(key.WithKeys("r"), key.WithHelp("r", "receive limit")),
 	}
 }
 
 type KeyMap struct {
-	Quit       key.Binding
-	Cancel     key.Binding
-	FileSelect key.Binding
+	Quit         key.Binding
+	Cancel       key.Binding
+	FileSelect   key.Binding
+	SendLimit    key.Binding
+	ReceiveLimit key.Binding
 }
 
 func (k KeyMap) ShortHelp() []key.Binding {
-	return []key.Binding{k.Quit, k.Cancel}
+	return []key.Binding{k.Quit, k.Cancel, k.SendLimit, k.ReceiveLimit}
 }
 
 func (k KeyMap) FullHelp() [][]key.Binding {
 	return [][]key.Binding{
 		{k.Quit, k.Cancel},
+		{k.SendLimit, k.ReceiveLimit},
+	}
+}
+
+func peerAlias(s *sessions.Session) string {
+	if s.Peer == nil {
+		return "unknown peer"
 	}
+	return s.Peer.Alias
 }
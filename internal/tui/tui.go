@@ -2,16 +2,20 @@ package tui
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 
+	"github.com/charmbracelet/bubbles/key"
 	tea "github.com/charmbracelet/bubbletea"
 
 	"github.com/atomic-7/gocalsend/internal/config"
 	"github.com/atomic-7/gocalsend/internal/data"
+	"github.com/atomic-7/gocalsend/internal/ratelimit"
 	sessionmanager "github.com/atomic-7/gocalsend/internal/sessions"
 	"github.com/atomic-7/gocalsend/internal/tui/filepicker"
 	"github.com/atomic-7/gocalsend/internal/tui/hooks"
 	"github.com/atomic-7/gocalsend/internal/tui/peers"
+	"github.com/atomic-7/gocalsend/internal/tui/pin"
 	screens "github.com/atomic-7/gocalsend/internal/tui/screens"
 	"github.com/atomic-7/gocalsend/internal/tui/sessions"
 	"github.com/atomic-7/gocalsend/internal/tui/transfers"
@@ -25,10 +29,14 @@ type Model struct {
 	sessionModel sessions.Model
 	filepicker   filepicker.Model
 	transfers    transfers.Model
+	pinModel     pin.Model
 	config       *config.Config
 	node         *data.PeerInfo
 	Uploader     *uploader.Uploader
 	Context      context.Context
+	// uploads started from the tui, cancelling them also stops uploads that still wait for a busy peer
+	uploadCtx     context.Context
+	cancelUploads context.CancelFunc
 }
 
 type AddSessionManager *sessionmanager.SessionManager
@@ -39,6 +47,7 @@ func NewModel(ctx context.Context, node *data.PeerInfo, appconfig *config.Config
 		prevScreen: screens.PeerScreen,
 		peerModel:  peers.NewPSModel(),
 		filepicker: filepicker.New(),
+		pinModel:   pin.New(),
 		config:     appconfig,
 		node:       node,
 		Context:    ctx,
@@ -50,6 +59,12 @@ func (m *Model) SetupSessionManagers(sman *sessionmanager.SessionManager) {
 	m.transfers = transfers.New(sman)
 }
 
+// the bandwidth limits that can be changed on the transfers screen
+func (m *Model) SetupBandwidth(send *ratelimit.Bandwidth, receive *ratelimit.Bandwidth) {
+	m.transfers.SendLimit = send
+	m.transfers.ReceiveLimit = receive
+}
+
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case *hooks.SessionOffer:
@@ -59,6 +74,14 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case *hooks.SessionCancelled:
 		slog.Debug("session cancelled", slog.String("src", "main update"))
 		m.screen = screens.FileSelectScreen
+	case hooks.FileFailed, hooks.UploadFailed, hooks.FileProgress:
+		// failures and progress are collected by the transfers screen even while it is not shown
+		m.transfers, _ = m.transfers.Update(msg)
+		return m, nil
+	case pin.RequiredMsg:
+		slog.Debug("peer requires a pin", slog.String("src", "main update"))
+		m.screen = screens.PinScreen
+		return m, m.pinModel.Reset()
 	case peers.AddPeerMsg:
 		m.peerModel.AddPeer(msg)
 		slog.Debug("received peermessage", slog.String("peer", msg.Alias))
@@ -97,24 +120,23 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			slog.Debug("uploading files", slog.String("file", m.filepicker.Selected[0]))
 			// send file, display ongoing transfers
 			m.screen = screens.TransfersScreen
-			cmd = tea.Batch(cmd, func() tea.Msg {
-				err := m.Uploader.UploadFiles(m.peerModel.GetPeer(), m.filepicker.Selected)
-				if err != nil {
-					if err.Error() == "Rejected" {
-						slog.Debug("upload cancelled by peer")
-						return hooks.SessionCancelled(true)
-					} else {
-						slog.Error("upload failed", slog.Any("error", err))
-					}
-					return nil
-				}
-				slog.Debug("uploader finished")
-				return nil
-			}, func() tea.Msg {
+			cmd = tea.Batch(cmd, m.startUpload(""), func() tea.Msg {
 				// TODO: see if this is still needed
 				return hooks.SessionCreated(true)
 			})
 		}
+	case screens.PinScreen:
+		m.pinModel, cmd = m.pinModel.Update(msg)
+		if m.pinModel.Cancelled {
+			m.filepicker.Done = false
+			m.peerModel.Done = false
+			m.screen = screens.FileSelectScreen
+			return m, nil
+		}
+		if m.pinModel.Done {
+			m.screen = screens.TransfersScreen
+			cmd = m.startUpload(m.pinModel.Value())
+		}
 	case screens.FileSelectScreen:
 		m.filepicker, cmd = m.filepicker.Update(msg)
 		if m.filepicker.Done {
@@ -122,12 +144,56 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.screen = screens.PeerScreen
 		}
 	case screens.TransfersScreen:
+		if msg, ok := msg.(tea.KeyMsg); ok && (key.Matches(msg, m.transfers.KeyMap.Cancel) || key.Matches(msg, m.transfers.KeyMap.Quit)) {
+			// uploads that wait for a busy peer have no session yet, cancelling the sessions would miss them
+			m.stopUploads()
+		}
 		m.transfers, cmd = m.transfers.Update(msg)
 	}
 
 	return m, cmd
 }
 
+// upload the selected files with the context shared by all uploads of the tui
+func (m *Model) startUpload(pinCode string) tea.Cmd {
+	if m.uploadCtx == nil {
+		m.uploadCtx, m.cancelUploads = context.WithCancel(m.Context)
+	}
+	return m.uploadFiles(m.uploadCtx, pinCode)
+}
+
+// cancel all running uploads, the next upload gets a fresh context
+func (m *Model) stopUploads() {
+	if m.cancelUploads != nil {
+		m.cancelUploads()
+	}
+	m.uploadCtx, m.cancelUploads = nil, nil
+}
+
+// upload the selected files to the selected peer
+func (m Model) uploadFiles(ctx context.Context, pinCode string) tea.Cmd {
+	return func() tea.Msg {
+		err := m.Uploader.UploadFiles(ctx, m.peerModel.GetPeer(), m.filepicker.Selected, pinCode)
+		if err != nil {
+			if errors.Is(err, uploader.ErrInvalidPin) {
+				return pin.RequiredMsg{}
+			}
+			if errors.Is(err, uploader.ErrRejected) {
+				slog.Debug("upload cancelled by peer")
+				return hooks.SessionCancelled(true)
+			}
+			if errors.Is(err, context.Canceled) {
+				slog.Debug("upload cancelled")
+				return hooks.SessionCancelled(true)
+			}
+			slog.Error("upload failed", slog.Any("error", err))
+			return hooks.UploadFailed{Reason: err}
+		}
+		slog.Debug("uploader finished")
+		return nil
+	}
+}
+
 func (m Model) View() string {
 	switch m.screen {
 	case screens.PeerScreen:
@@ -138,6 +204,8 @@ func (m Model) View() string {
 		return m.filepicker.View()
 	case screens.TransfersScreen:
 		return m.transfers.View()
+	case screens.PinScreen:
+		return m.pinModel.View()
 	}
 	return "wth no scren?"
 }
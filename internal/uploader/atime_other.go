@@ -0,0 +1,13 @@
+//go:build !linux && !openbsd && !dragonfly && !solaris && !illumos && !darwin && !freebsd && !netbsd && !windows
+
+package uploader
+
+import (
+	"os"
+	"time"
+)
+
+// the access time is not available on this platform, the modification time is the closest approximation
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,17 @@
+//go:build linux || openbsd || dragonfly || solaris || illumos
+
+package uploader
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// returns the last access time of a file, falls back to the modification time
+func accessTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,15 @@
+package uploader
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// returns the last access time of a file, falls back to the modification time
+func accessTime(info os.FileInfo) time.Time {
+	if fd, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, fd.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
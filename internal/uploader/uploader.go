@@ -3,26 +3,74 @@ package uploader
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/atomic-7/gocalsend/internal/data"
+	"github.com/atomic-7/gocalsend/internal/ratelimit"
 	"github.com/atomic-7/gocalsend/internal/sessions"
+	"golang.org/x/sync/errgroup"
 )
 
+// returned when the peer requires a pin and none or an invalid one was supplied
+var ErrInvalidPin = errors.New("Invalid pin")
+
+// the peer rate limits requests, uploads are retried after a while
+var errTooManyRequests = errors.New("Too many requests")
+
+// the peer has a different part of the file than the upload assumed, the upload continues at the offset the peer reports
+var errResumeOffset = errors.New("Invalid resume offset")
+
+// the peer is still writing the file from an earlier attempt, the upload is retried once that is done
+var errFileBusy = errors.New("File is already being received")
+
+// returned when the peer is busy receiving another session
+var ErrBlocked = errors.New("Peer is busy with another session")
+
+// returned when the peer declined the session
+var ErrRejected = errors.New("Rejected")
+
+// returned when two of the files to send end up with the same name at the peer, e.g. a/photos and b/photos
+var ErrDuplicateFile = errors.New("Duplicate file name")
+
 type Uploader struct {
 	node      *data.PeerInfo
 	client    *http.Client
 	tlsclient *http.Client
 	SessMan   *sessions.SessionManager
+	// compute the sha256 of files before offering them so peers can verify them
+	HashFiles bool
+	// number of files that are uploaded in parallel
+	Workers int
+	// how often to offer a session again while the peer is busy with another session
+	BlockedRetries int
+	// caps the bandwidth of uploads, nil for no limit
+	Bandwidth *ratelimit.Bandwidth
+	hashes    map[hashKey]string
+	hashLock  sync.Mutex
+}
+
+// hashes are cached per file version, a changed modification time or size invalidates the cached hash
+type hashKey struct {
+	path     string
+	modified time.Time
+	size     int64
 }
 
 // node is the peerinfo of the local node
@@ -31,11 +79,12 @@ func CreateUploader(node *data.PeerInfo, sman *sessions.SessionManager) *Uploade
 
 	// TODO: Look into cloning the default transport
 	// https://stackoverflow.com/questions/12122159/how-to-do-a-https-request-with-bad-certificate
+	// no overall client timeout, uploading large files can take longer than any fixed limit.
+	// requests that should time out get a context with a deadline instead
 	client := &http.Client{
 		Transport: &http.Transport{
 			ResponseHeaderTimeout: time.Duration(60 * time.Second),
 		},
-		Timeout: time.Duration(120 * time.Second),
 	}
 	tlsclient := &http.Client{
 		Transport: &http.Transport{
@@ -44,135 +93,415 @@ func CreateUploader(node *data.PeerInfo, sman *sessions.SessionManager) *Uploade
 			},
 			ResponseHeaderTimeout: time.Duration(60 * time.Second),
 		},
-		Timeout: time.Duration(120 * time.Second),
 	}
 	return &Uploader{
 		node:      node,
 		client:    client,
 		tlsclient: tlsclient,
 		SessMan:   sman,
+		Workers:   1,
+		hashes:    make(map[hashKey]string),
 	}
 }
 
-// peer is the peerinfo of the target remote, files is a list of filepaths
-func (cl *Uploader) UploadFiles(peer *data.PeerInfo, files []string) error {
+// peer is the peerinfo of the target remote, files is a list of filepaths.
+// pin can be empty if the peer does not require one. Returns ErrInvalidPin if the peer asks for a (different) pin
+func (cl *Uploader) UploadFiles(ctx context.Context, peer *data.PeerInfo, files []string, pin string) error {
+	idmap, err := cl.CollectFiles(files)
+	if err != nil {
+		return err
+	}
+	return cl.upload(ctx, peer, idmap, pin)
+}
+
+// Send a text message to the peer. The text is sent as preview of a text file,
+// the file is only uploaded if the peer does not display the preview on its own
+func (cl *Uploader) SendText(ctx context.Context, peer *data.PeerInfo, text string, pin string) error {
+	fileName := fmt.Sprintf("%d.txt", time.Now().UnixNano())
+	file := &data.File{
+		ID:       cl.genID(fileName),
+		FileName: fileName,
+		Size:     int64(len(text)),
+		FileType: "text/plain",
+		Preview:  text,
+	}
+	return cl.upload(ctx, peer, map[string]*data.File{file.ID: file}, pin)
+}
 
-	sessionID, err := cl.prepareUpload(peer, files)
+func (cl *Uploader) upload(ctx context.Context, peer *data.PeerInfo, idmap map[string]*data.File, pin string) error {
+
+	sessionID, err := cl.prepareUpload(ctx, peer, idmap, pin)
+	for attempt := 1; errors.Is(err, ErrBlocked) && attempt <= cl.BlockedRetries; attempt++ {
+		// back off exponentially, a large transfer of another peer can take a while
+		wait := min(time.Duration(1<<attempt)*time.Second, maxBlockedWait)
+		slog.Info("peer is busy with another session, retrying", slog.String("peer", peer.Alias), slog.Int("attempt", attempt), slog.Duration("wait", wait))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		sessionID, err = cl.prepareUpload(ctx, peer, idmap, pin)
+	}
 	if err != nil {
-		// TODO: pass in a context to use?
 		slog.Error("failed to prepare file upload", slog.Any("error", err))
 		return err
 	}
+	if sessionID == "" {
+		slog.Info("peer needs no file transfer", slog.String("peer", peer.Alias))
+		return nil
+	}
 
-	sess := cl.SessMan.Uploads[sessionID]
-	ctx := sess.GetCtx()
+	sess, ok := cl.SessMan.Upload(sessionID)
+	if !ok {
+		return errors.New("upload session vanished before the upload started")
+	}
+	// cancelling the caller cancels the session, which stops the running transfers and tells the peer below
+	stop := context.AfterFunc(ctx, func() {
+		cl.SessMan.CancelSession(sessionID)
+	})
+	defer stop()
+	// the first failed file cancels the uploads of its siblings via the group context
+	group, groupCtx := errgroup.WithContext(sess.GetCtx())
+	group.SetLimit(max(cl.Workers, 1))
 	for _, file := range sess.Files {
-		select {
-		case <-ctx.Done():
-			// TODO: clean up downloaded files?
-			// break is useless here but just putting something here for now
+		if groupCtx.Err() != nil {
 			break
-		default:
+		}
+		group.Go(func() error {
 			slog.Info("uploading file", slog.String("file", file.FileName))
-			err = cl.singleUpload(ctx, peer, sess.SessionID, file)
+			err := cl.uploadWithRetries(groupCtx, peer, sessionID, file)
 			if err != nil {
 				slog.Error("failed to upload", slog.String("file", file.FileName), slog.Any("error", err))
-				if !errors.Is(err, context.Canceled) {
-					slog.Debug("cancelling session because the error was not a context cancel")
-					cl.SessMan.CancelSession(sessionID)
-				}
 				return err
 			}
 			cl.SessMan.FinishFile(sessionID, file.ID)
-
+			return nil
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Debug("cancelling session because the error was not a context cancel")
+			cl.SessMan.CancelSession(sessionID)
 		}
-
+		// the peer would otherwise keep the session open and block other transfers
+		cl.cancelRemote(peer, sessionID)
+		return err
 	}
 	return nil
 }
 
+// Tell the peer that a session will not be completed
+func (cl *Uploader) cancelRemote(peer *data.PeerInfo, sessID string) {
+	endpoint := &url.URL{
+		Scheme: "http",
+		Host:   fmt.Sprintf("%s:%d", peer.IP, peer.Port),
+		Path:   "/api/localsend/v2/cancel",
+	}
+	if peer.IsV1() {
+		// v1 has no session ids, the peer cancels everything it receives from us
+		endpoint.Path = "/api/localsend/v1/cancel"
+	} else {
+		params := url.Values{}
+		params.Add("sessionId", sessID)
+		endpoint.RawQuery = params.Encode()
+	}
+	client := cl.client
+	if peer.Protocol == "https" {
+		endpoint.Scheme = "https"
+		client = cl.tlsclient
+	}
+	// the context of the session is already done at this point
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.String(), nil)
+	if err != nil {
+		slog.Error("failed to create cancel request", slog.Any("error", err))
+		return
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Error("failed to cancel session at peer", slog.String("peer", peer.Alias), slog.Any("error", err))
+		return
+	}
+	resp.Body.Close()
+	slog.Debug("cancelled session at peer", slog.String("peer", peer.Alias), slog.String("sessionId", sessID), slog.Int("status", resp.StatusCode))
+}
+
 func (cl *Uploader) genID(file string) string {
 	return "ID-" + file
 }
 
-func (cl *Uploader) prepareUpload(peer *data.PeerInfo, filePaths []string) (string, error) {
-
-	// TODO: Implement pins
-
+// Stat the files at the given paths and collect their info for a session. Directories are sent recursively.
+// The returned map is keyed by file id
+func (cl *Uploader) CollectFiles(filePaths []string) (map[string]*data.File, error) {
 	idmap := make(map[string]*data.File, len(filePaths))
 	for _, path := range filePaths {
 		info, err := os.Stat(path)
 		if err != nil {
 			slog.Error("Failed to stat", slog.String("file", path), slog.Any("error", err))
-			return "", err
-		}
-		fileName := info.Name()
-		fileID := cl.genID(fileName)
-		idmap[fileID] = &data.File{
-			ID:          cl.genID(fileName),
-			FileName:    fileName,
-			Size:        info.Size(),
-			Destination: path,
-			Metadata: &data.MetaData{
-				Modified: info.ModTime(),
-				Accessed: time.Now(),
-			},
+			return nil, err
+		}
+		if !info.IsDir() {
+			file, err := cl.collectFile(path, info.Name(), info)
+			if err != nil {
+				return nil, err
+			}
+			if err := addFile(idmap, file, path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = cl.collectDir(path, idmap)
+		if err != nil {
+			slog.Error("Failed to collect directory", slog.String("dir", path), slog.Any("error", err))
+			return nil, err
+		}
+	}
+	return idmap, nil
+}
+
+// Walk a directory and add every regular file in it. File names are relative to the parent of the directory
+// and use forward slashes like the reference client, so the peer can recreate the tree
+func (cl *Uploader) collectDir(root string, idmap map[string]*data.File) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	parent := filepath.Dir(abs)
+	return filepath.WalkDir(abs, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
+		// symlinks are not followed when walking, only regular files are sent
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		file, err := cl.collectFile(path, filepath.ToSlash(rel), info)
+		if err != nil {
+			return err
+		}
+		return addFile(idmap, file, path)
+	})
+}
+
+// the file name is the id, so a second file with the same name would silently replace the first one
+func addFile(idmap map[string]*data.File, file *data.File, path string) error {
+	if _, ok := idmap[file.ID]; ok {
+		slog.Error("Another file has the same name", slog.String("file", path), slog.String("name", file.FileName))
+		return fmt.Errorf("%w: %s", ErrDuplicateFile, file.FileName)
+	}
+	idmap[file.ID] = file
+	return nil
+}
+
+func (cl *Uploader) collectFile(path string, fileName string, info fs.FileInfo) (*data.File, error) {
+	fileType, err := detectFileType(path)
+	if err != nil {
+		slog.Error("Failed to detect file type", slog.String("file", path), slog.Any("error", err))
+		return nil, err
+	}
+	checksum := ""
+	if cl.HashFiles {
+		checksum, err = cl.hashFile(path, info)
+		if err != nil {
+			slog.Error("Failed to hash", slog.String("file", path), slog.Any("error", err))
+			return nil, err
+		}
+	}
+	return &data.File{
+		ID:          cl.genID(fileName),
+		FileName:    fileName,
+		Size:        info.Size(),
+		FileType:    fileType,
+		Sha256:      checksum,
+		Destination: path,
+		Metadata: &data.MetaData{
+			Modified: info.ModTime(),
+			Accessed: accessTime(info),
+		},
+	}, nil
+}
+
+// upper bound for the wait between offers to a busy peer
+const maxBlockedWait = 60 * time.Second
+
+// Read the reason a peer gave in the body of an error response, limited to a length that fits in a log line.
+// gocalsend and the reference implementation send a json message, other peers might answer with plain text
+func peerReason(resp *http.Response) string {
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if err != nil {
+		return ""
+	}
+	var body struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(buf, &body) == nil {
+		return body.Message
+	}
+	return string(bytes.TrimSpace(buf))
+}
+
+// Attach the reason the peer gave to err, unless it only repeats it
+func peerError(resp *http.Response, err error) error {
+	reason := peerReason(resp)
+	if reason == "" || strings.EqualFold(reason, err.Error()) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, reason)
+}
+
+// Determine the mime type of a file by its extension. Files with unknown extensions are sniffed.
+// Parameters like the charset are dropped, peers only expect the media type
+func detectFileType(path string) (string, error) {
+	if fileType := mime.TypeByExtension(filepath.Ext(path)); fileType != "" {
+		return stripParams(fileType), nil
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	// DetectContentType considers at most 512 bytes
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(fh, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	return stripParams(http.DetectContentType(buf[:n])), nil
+}
+
+func stripParams(fileType string) string {
+	mediaType, _, err := mime.ParseMediaType(fileType)
+	if err != nil {
+		return fileType
+	}
+	return mediaType
+}
+
+// Compute the sha256 of a file as hex string. Hashes are cached so sending the same file again is cheap
+func (cl *Uploader) hashFile(path string, info os.FileInfo) (string, error) {
+	key := hashKey{path: path, modified: info.ModTime(), size: info.Size()}
+	cl.hashLock.Lock()
+	checksum, ok := cl.hashes[key]
+	cl.hashLock.Unlock()
+	if ok {
+		return checksum, nil
 	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, fh)
+	if err != nil {
+		return "", err
+	}
+	checksum = hex.EncodeToString(hasher.Sum(nil))
+	slog.Debug("hashed file", slog.String("file", path), slog.String("sha256", checksum))
+
+	cl.hashLock.Lock()
+	cl.hashes[key] = checksum
+	cl.hashLock.Unlock()
+	return checksum, nil
+}
+
+// Send the session offer to the peer. Returns an empty session id if the peer does not need any files to be uploaded
+func (cl *Uploader) prepareUpload(ctx context.Context, peer *data.PeerInfo, idmap map[string]*data.File, pin string) (string, error) {
 	payload := data.PreparePayload{
 		Info:  cl.node,
 		Files: idmap,
 	}
-	endpoint, err := url.Parse("/api/localsend/v2/prepare-upload")
+	endpointPath := "/api/localsend/v2/prepare-upload"
+	if peer.IsV1() {
+		endpointPath = "/api/localsend/v1/send-request"
+	}
+	endpoint, err := url.Parse(endpointPath)
 	if err != nil {
 		slog.Error("failed to parse endpoint string", slog.Any("error", err))
-		os.Exit(1)
+		return "", err
 	}
 	endpoint.Host = fmt.Sprintf("%s:%d", peer.IP, peer.Port)
 	endpoint.Scheme = "http"
 	if peer.Protocol == "https" {
 		endpoint.Scheme = "https"
 	}
+	// v1 has no pins
+	if pin != "" && !peer.IsV1() {
+		params := url.Values{}
+		params.Add("pin", pin)
+		endpoint.RawQuery = params.Encode()
+	}
 	jsonPayload, err := json.Marshal(payload)
 
 	if err != nil {
 		slog.Error("Failed to marshal prep-upload data", slog.Any("error", err))
-		os.Exit(1)
+		return "", err
 	}
 	client := cl.client
 	if peer.Protocol == "https" {
 		client = cl.tlsclient
 	}
-	resp, err := client.Post(endpoint.String(), "application/json", bytes.NewReader(jsonPayload))
+	ctx, cancel := context.WithTimeout(ctx, 120*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.String(), bytes.NewReader(jsonPayload))
+	if err != nil {
+		slog.Error("failed to create prepare-upload request", slog.Any("error", err))
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
 	if err != nil {
 		slog.Error("error sending prepare-upload payload", slog.Any("error", err))
 		return "", err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		switch resp.StatusCode {
+		case 204:
+			return "", nil
 		case 400:
-			return "", errors.New("Invalid body")
+			return "", peerError(resp, errors.New("Invalid body"))
 		case 401:
-			return "", errors.New("Invalid pin")
+			return "", peerError(resp, ErrInvalidPin)
 		case 403:
-			return "", errors.New("Rejected")
+			return "", peerError(resp, ErrRejected)
 		case 409:
-			return "", errors.New("Blocked by another session")
+			return "", peerError(resp, ErrBlocked)
+		case 413, 507:
+			// size limits of the peer, the body says which one was hit
+			return "", peerError(resp, errors.New("Peer refused the session"))
 		case 429:
-			return "", errors.New("Too many requests")
+			return "", peerError(resp, errTooManyRequests)
 		case 500:
-			return "", errors.New("Server error")
+			return "", peerError(resp, errors.New("Server error"))
 		default:
-			return "", errors.New("Somthing is not good. And it's you.")
+			return "", peerError(resp, errors.New("Somthing is not good. And it's you."))
 		}
 	}
 	respBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
 		slog.Error("failed to read prep-upload response", slog.Any("error", err))
-		os.Exit(1)
+		return "", err
 	}
 	var sessInfo data.SessionInfo
-	err = json.Unmarshal(respBytes, &sessInfo)
+	if peer.IsV1() {
+		// v1 only answers with the file tokens, the session id is only used locally
+		sessInfo.SessionID = fmt.Sprintf("v1-%s-%d", peer.IP, time.Now().UnixNano())
+		err = json.Unmarshal(respBytes, &sessInfo.Files)
+	} else {
+		err = json.Unmarshal(respBytes, &sessInfo)
+	}
 	if err != nil {
 		slog.Error("failed to unmarshal session info for prep-upload", slog.Any("error", err))
 		return "", err
@@ -184,56 +513,137 @@ func (cl *Uploader) prepareUpload(peer *data.PeerInfo, filePaths []string) (stri
 	return sessID, nil
 }
 
-func (cl *Uploader) singleUpload(ctx context.Context, peer *data.PeerInfo, sessID string, file *data.File) error {
+// number of attempts to upload a file before the session is given up
+const maxAttempts = 5
+
+// Upload a file and retry if the connection drops. Gocalsend peers keep the partial file, so retries continue where the last attempt stopped
+func (cl *Uploader) uploadWithRetries(ctx context.Context, peer *data.PeerInfo, sessID string, file *data.File) error {
+	var offset int64
+	for attempt := 1; ; attempt++ {
+		err := cl.singleUpload(ctx, peer, sessID, file, offset)
+		// only connection errors, rate limits and races with a stale upload are worth a retry, the peer answered every other error deliberately
+		var urlErr *url.Error
+		retry := errors.As(err, &urlErr) || errors.Is(err, errTooManyRequests) || errors.Is(err, errResumeOffset) || errors.Is(err, errFileBusy)
+		if err == nil || ctx.Err() != nil || !retry || attempt >= maxAttempts {
+			return err
+		}
+		slog.Warn("upload interrupted, retrying", slog.String("file", file.FileName), slog.Int("attempt", attempt), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		}
+		offset = cl.queryOffset(ctx, peer, sessID, file)
+	}
+}
 
-	base := url.URL{}
+// returns the upload url for a file and the client to use for the peer
+func (cl *Uploader) uploadURL(peer *data.PeerInfo, sessID string, file *data.File) (*url.URL, *http.Client) {
+	base := &url.URL{}
 	base.Scheme = "http"
 	base.Host = fmt.Sprintf("%s:%d", peer.IP, peer.Port)
 	base.Path = "/api/localsend/v2/upload"
 
 	params := url.Values{}
-	params.Add("sessionId", sessID)
+	if peer.IsV1() {
+		base.Path = "/api/localsend/v1/send"
+	} else {
+		params.Add("sessionId", sessID)
+	}
 	params.Add("fileId", file.ID)
 	params.Add("token", file.Token)
 	base.RawQuery = params.Encode()
 
-	fh, err := os.Open(file.Destination)
-	if err != nil {
-		slog.Error("failed to open file for upload", slog.Any("error", err))
-		os.Exit(1)
-	}
-	defer fh.Close()
-
 	client := cl.client
 	if peer.Protocol == "https" {
 		base.Scheme = "https"
 		client = cl.tlsclient
 	}
-	req, err := http.NewRequestWithContext(ctx, "POST", base.String(), fh)
-	req.Header.Set("Content-Type", "application/octet-stream")
+	return base, client
+}
+
+// Ask the peer how much of a file it already received. Peers that are not gocalsend do not support resuming, for them this is always 0
+func (cl *Uploader) queryOffset(ctx context.Context, peer *data.PeerInfo, sessID string, file *data.File) int64 {
+	endpoint, client := cl.uploadURL(peer, sessID, file)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", endpoint.String(), nil)
+	if err != nil {
+		return 0
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Debug("failed to query upload offset", slog.String("file", file.FileName), slog.Any("error", err))
+		return 0
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0
+	}
+	offset, err := strconv.ParseInt(resp.Header.Get(data.ResumeOffsetHeader), 10, 64)
+	if err != nil || offset < 0 || offset > file.Size {
+		return 0
+	}
+	slog.Debug("peer reported upload offset", slog.String("file", file.FileName), slog.Int64("offset", offset))
+	return offset
+}
+
+// upload a file starting at offset. An offset > 0 is sent as Content-Range header so the peer appends to the partial file
+func (cl *Uploader) singleUpload(ctx context.Context, peer *data.PeerInfo, sessID string, file *data.File, offset int64) error {
+
+	endpoint, client := cl.uploadURL(peer, sessID, file)
+
+	// text messages have no file on disk, their content is the preview
+	var body io.Reader = strings.NewReader(file.Preview)
+	if file.Destination != "" {
+		fh, err := os.Open(file.Destination)
+		if err != nil {
+			slog.Error("failed to open file for upload", slog.Any("error", err))
+			return err
+		}
+		defer fh.Close()
+		_, err = fh.Seek(offset, io.SeekStart)
+		if err != nil {
+			slog.Error("failed to seek to upload offset", slog.Int64("offset", offset), slog.Any("error", err))
+			return err
+		}
+		body = cl.SessMan.TrackProgress(sessID, file, offset, cl.Bandwidth.Reader(ctx, peer.IP.String(), fh))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint.String(), body)
 	if err != nil {
 		slog.Error("failed to create request with context", slog.Any("error", err))
 		return err
 	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if file.Destination != "" {
+		req.ContentLength = file.Size - offset
+	}
+	if offset > 0 {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, file.Size-1, file.Size))
+	}
 	resp, err := client.Do(req)
 
 	// resp, err := client.Post(base.String(), "Content-Type:application/octet-stream", fh)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		switch resp.StatusCode {
 		case 400:
-			return errors.New("Missing parameters")
+			return peerError(resp, errors.New("Missing parameters"))
 		case 403:
-			return errors.New("Invalid token or ip address")
+			return peerError(resp, errors.New("Invalid token or ip address"))
 		case 409:
-			return errors.New("Blocked by another session")
+			return peerError(resp, errFileBusy)
+		case 416:
+			return peerError(resp, errResumeOffset)
+		case 429:
+			return peerError(resp, errTooManyRequests)
 		case 500:
-			return errors.New("Server error")
+			return peerError(resp, errors.New("Server error"))
 		default:
-			return errors.New("Something is not good. And it's really you.")
+			return peerError(resp, errors.New("Something is not good. And it's really you."))
 		}
 	}
 	return nil